@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// access log formats
+const (
+	accessLogFormatCombined = "combined"
+	accessLogFormatJSON     = "json"
+)
+
+// command line flags
+var accessLogOutput = "stdout"
+var accessLogFormat = accessLogFormatCombined
+
+// access log written by the accessLogRequests middleware, separate from the application logger
+// nil until opened, requests are then not logged
+var accessLog *accessLogger
+
+type accessLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	file   *os.File
+	format string
+}
+
+// one line per request in the access log
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	ClientIP   string    `json:"clientIp"`
+	KeyID      string    `json:"keyId,omitempty"`
+	RequestID  string    `json:"requestId"`
+	Method     string    `json:"method"`
+	Route      string    `json:"route"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	DurationMs float64   `json:"durationMs"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+}
+
+// function to open the access log, output is stdout, stderr or a file appended to
+func openAccessLog(output string, format string) (*accessLogger, error) {
+	if format != accessLogFormatCombined && format != accessLogFormatJSON {
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+	l := &accessLogger{format: format}
+	switch output {
+	case "stdout":
+		l.w = os.Stdout
+	case "stderr":
+		l.w = os.Stderr
+	default:
+		file, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		l.w, l.file = file, file
+	}
+	return l, nil
+}
+
+// function to close the access log file
+func (l *accessLogger) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file, l.w = nil, io.Discard
+	return err
+}
+
+func (l *accessLogger) write(entry accessLogEntry) {
+	var line []byte
+	if l.format == accessLogFormatJSON {
+		line, _ = json.Marshal(entry)
+		line = append(line, '\n')
+	} else {
+		line = []byte(combinedLogLine(entry))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+}
+
+// function to format an entry in the Combined Log Format, followed by the duration in milliseconds
+// the authenticated key ID is used as the user, quoted fields are escaped
+func combinedLogLine(entry accessLogEntry) string {
+	user, bytes, referer, userAgent := "-", "-", "-", "-"
+	if entry.KeyID != "" {
+		user = entry.KeyID
+	}
+	if entry.Bytes > 0 {
+		bytes = strconv.Itoa(entry.Bytes)
+	}
+	if entry.Referer != "" {
+		referer = entry.Referer
+	}
+	if entry.UserAgent != "" {
+		userAgent = entry.UserAgent
+	}
+	return fmt.Sprintf("%s - %s [%s] %s %d %s %s %s %.3f\n",
+		entry.ClientIP, user, entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(entry.Method+" "+entry.Route+" "+entry.Proto),
+		entry.Status, bytes, strconv.Quote(referer), strconv.Quote(userAgent), entry.DurationMs)
+}
+
+const accessLogContextKey contextKey = "accessLog"
+
+// details filled in further down the middleware chain while serving a request
+type requestAccess struct {
+	keyID string
+}
+
+// function to attach the authenticated key ID to the access log entry of a request
+func accessLogKeyID(r *http.Request, keyID string) {
+	if details, ok := r.Context().Value(accessLogContextKey).(*requestAccess); ok {
+		details.keyID = keyID
+	}
+}
+
+// function to write an access log line for every request
+// the route is the path template so receipt IDs are not logged, unmatched requests log the path
+func accessLogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accessLog == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		details := &requestAccess{}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), accessLogContextKey, details)))
+
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		accessLog.write(accessLogEntry{
+			Time:       start,
+			ClientIP:   clientIP(r),
+			KeyID:      details.keyID,
+			RequestID:  requestIDFromContext(r.Context()),
+			Method:     r.Method,
+			Route:      route,
+			Proto:      r.Proto,
+			Status:     recorder.status,
+			Bytes:      recorder.bytes,
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+		})
+	})
+}
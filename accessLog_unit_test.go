@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	var output bytes.Buffer
+	accessLog = &accessLogger{w: &output, format: accessLogFormatJSON}
+	defer func() { accessLog = nil }()
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"access-user"})
+	userID := APIKeys["access-user"]
+	router := newRouter()
+
+	send := func(path, apiKey string) {
+		sendRequest(router, "GET", path, apiKey, "", map[string]string{"User-Agent": "access-test", requestIDHeader: "access-request"})
+	}
+
+	// authenticated request, unauthenticated request and unknown route
+	send("/receipts/abc/points", "access-user")
+	send("/receipts/abc/points", "")
+	send("/unknown", "access-user")
+
+	var entries []accessLogEntry
+	decoder := json.NewDecoder(&output)
+	for decoder.More() {
+		var entry accessLogEntry
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 access log entries, got %d", len(entries))
+	}
+	expected := []accessLogEntry{
+		{KeyID: userID, Route: "/receipts/{id}/points", Status: http.StatusNotFound},
+		{KeyID: "", Route: "/receipts/{id}/points", Status: http.StatusUnauthorized},
+		{KeyID: "", Route: "/unknown", Status: http.StatusNotFound},
+	}
+	for i, e := range expected {
+		got := entries[i]
+		if got.KeyID != e.KeyID || got.Route != e.Route || got.Status != e.Status || got.Method != "GET" || got.Bytes == 0 ||
+			got.ClientIP != "192.0.2.1" || got.UserAgent != "access-test" || got.RequestID != "access-request" {
+			t.Errorf("Entry %d: expected %+v, got %+v", i, e, got)
+		}
+	}
+
+	// combined log format
+	output.Reset()
+	accessLog.format = accessLogFormatCombined
+	send("/receipts/abc/points", "access-user")
+	combined := regexp.MustCompile(`^192\.0\.2\.1 - ` + regexp.QuoteMeta(userID) + ` \[[^\]]+\] "GET /receipts/\{id\}/points HTTP/1\.1" 404 \d+ "-" "access-test" \d+\.\d{3}\n$`)
+	if !combined.MatchString(output.String()) {
+		t.Errorf("Unexpected combined log line %q", output.String())
+	}
+	if strings.Contains(output.String(), "abc") {
+		t.Error("Expected the receipt ID not to be logged")
+	}
+}
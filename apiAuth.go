@@ -1,35 +1,393 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
 )
 
 // simplified API keys in memory, want to be able to generate predicatble keys for testing
-var APIKeys = map[string]bool{}
+// maps the presented key (or its hash) to the key ID used to identify the caller
+var APIKeys = map[string]string{}
+
+// shared secrets used by partners to sign requests, keyed by the partner key ID, set from the -hmacsecrets command line flag
+var HMACSecrets = map[string]string{}
+
+// flag value for HMACSecrets in the form "partner1=secret1,partner2=secret2", setting it replaces every secret
+type hmacSecretsFlag struct{}
+
+func (hmacSecretsFlag) String() string {
+	secrets := make([]string, 0, len(HMACSecrets))
+	for keyID, secret := range HMACSecrets {
+		secrets = append(secrets, keyID+"="+secret)
+	}
+	slices.Sort(secrets)
+	return strings.Join(secrets, ",")
+}
+
+func (hmacSecretsFlag) Set(value string) error {
+	secrets := map[string]string{}
+	for _, setting := range strings.Split(value, ",") {
+		if strings.TrimSpace(setting) == "" {
+			continue
+		}
+		keyID, secret, _ := strings.Cut(strings.TrimSpace(setting), "=")
+		if keyID == "" || secret == "" {
+			return errors.New("secrets must be in the form keyId=secret")
+		}
+		secrets[keyID] = secret
+	}
+	HMACSecrets = secrets
+	return nil
+}
+
+// headers used by partners to sign requests
+const (
+	hmacKeyIDHeader     = "X-Key-ID"
+	hmacTimestampHeader = "X-Timestamp"
+	hmacNonceHeader     = "X-Nonce"
+	hmacSignatureHeader = "X-Signature"
+)
+
+// how far a signed request timestamp can drift from the server clock
+var hmacMaxClockSkew = 5 * time.Minute
+
+var usedNonces = newNonceCache()
+
+// authentication modes
+const (
+	authModeNone    = "none"
+	authModeAPIKey  = "apikey"
+	authModeJWT     = "jwt"
+	authModeHMAC    = "hmac"
+	authModeMTLS    = "mtls"
+	authModeChained = "chained"
+)
+
+// command line flags
+var authMode = authModeChained
+var authChain = "hmac,apikey"
+var routeAuthModes = "/metrics=none,/healthz=none,/readyz=none,/version=none,/openapi.json=none,/docs=none,/docs/{asset}=none"
+var jwtSecret string
+var jwtIssuer string
+var jwtAudience string
+
+// returned by an authenticator when the request carries none of its credentials
+var errNoCredentials = errors.New("no credentials provided")
+
+// an authenticator validates the credentials of a request and returns the caller identity
+// the identity may be returned alongside an error when the caller claimed one (e.g. HMAC key ID)
+type authenticator func(r *http.Request) (string, error)
+
+var authenticators = map[string]authenticator{
+	authModeAPIKey: authenticateAPIKey,
+	authModeJWT:    authenticateJWT,
+	authModeHMAC:   authenticateHMAC,
+	authModeMTLS:   authenticateClientCert,
+}
+
+type contextKey string
+
+const identityContextKey contextKey = "identity"
+
+// function to attach the authenticated identity to the request context and its logger
+func withIdentity(r *http.Request, identity string) *http.Request {
+	ctx := context.WithValue(r.Context(), identityContextKey, identity)
+	if identity != "" {
+		ctx = withLogger(ctx, loggerFromContext(ctx).With("keyId", identity))
+		accessLogKeyID(r, identity)
+	}
+	return r.WithContext(ctx)
+}
+
+// function to look up the authenticated identity of a request, empty if unauthenticated
+func identityFromRequest(r *http.Request) string {
+	return identityFromContext(r.Context())
+}
+
+// function to look up the authenticated identity of a request context, shared by the HTTP and gRPC APIs
+func identityFromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(identityContextKey).(string)
+	return identity
+}
 
 // function to create a hash of the API keys and store in memory
 // using an in memory solution for simplicity of code review
+// the key ID is a short fingerprint of the hash so the key itself never needs to be logged
 func hashAPIKeys(keys []string) {
 	for _, key := range keys {
 		hash := sha256.Sum256([]byte(key))
 		hashedKey := hex.EncodeToString(hash[:])
-		APIKeys[hashedKey] = true
-		APIKeys[key] = true
+		keyID := "key-" + hashedKey[:12]
+		APIKeys[hashedKey] = keyID
+		APIKeys[key] = keyID
+		logger.Info("registered API key", "keyId", keyID)
+	}
+}
+
+// function to validate the auth mode settings, called once the flags are parsed
+func validateAuthConfig() error {
+	modes := []string{authMode}
+	for _, override := range parseRouteAuthModes(routeAuthModes) {
+		modes = append(modes, override)
+	}
+	for _, mode := range modes {
+		if mode == authModeNone || mode == authModeChained {
+			continue
+		}
+		if _, found := authenticators[mode]; !found {
+			return fmt.Errorf("unknown auth mode %q", mode)
+		}
+	}
+	for _, mode := range strings.Split(authChain, ",") {
+		mode = strings.TrimSpace(mode)
+		if _, found := authenticators[mode]; !found {
+			return fmt.Errorf("unknown auth mode %q in auth chain", mode)
+		}
+		modes = append(modes, mode)
 	}
+	// the chain members need their settings as much as the auth mode and route overrides
+	for _, mode := range modes {
+		if mode == authModeMTLS && tlsClientCAFile == "" {
+			return errors.New("mtls auth mode requires -tlsclientca")
+		}
+		if mode == authModeJWT && jwtSecret == "" {
+			return errors.New("jwt auth mode requires -jwtsecret")
+		}
+	}
+	return nil
+}
+
+// function to parse per route auth overrides in the form "/healthz=none,/admin/*=apikey"
+func parseRouteAuthModes(overrides string) map[string]string {
+	modes := map[string]string{}
+	for _, override := range strings.Split(overrides, ",") {
+		route, mode, found := strings.Cut(strings.TrimSpace(override), "=")
+		if found {
+			modes[strings.TrimSpace(route)] = strings.TrimSpace(mode)
+		}
+	}
+	return modes
 }
 
-// function to handle api key validation
-func validateAPIKey(next http.Handler) http.Handler {
+// function to find the auth mode for a request
+// overrides match the route path template exactly, or by prefix when ending in *
+func authModeFor(r *http.Request, overrides map[string]string) string {
+	route := r.URL.Path
+	if current := mux.CurrentRoute(r); current != nil {
+		if template, err := current.GetPathTemplate(); err == nil {
+			route = template
+		}
+	}
+	if mode, found := overrides[route]; found {
+		return mode
+	}
+	longestPrefix := ""
+	mode := authMode
+	for pattern, override := range overrides {
+		prefix, isPrefix := strings.CutSuffix(pattern, "*")
+		if isPrefix && strings.HasPrefix(route, prefix) && len(prefix) >= len(longestPrefix) {
+			longestPrefix, mode = prefix, override
+		}
+	}
+	return mode
+}
+
+// function to handle authentication using the configured auth mode
+func authenticate(next http.Handler) http.Handler {
+	overrides := parseRouteAuthModes(routeAuthModes)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		apiKey := r.Header.Get("Authorization")
-		_, found := APIKeys[apiKey]
-		if !found {
-			logger.Println("Unauthorized request")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		mode := authModeFor(r, overrides)
+		if mode == authModeNone {
+			next.ServeHTTP(w, r)
+			return
+		}
+		identity, err := authenticateRequest(r, mode)
+		var tooLargeErr *http.MaxBytesError
+		if errors.As(err, &tooLargeErr) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, bodyTooLargeMessage())
 			return
 		}
-		next.ServeHTTP(w, r)
+		if err != nil {
+			loggerFromContext(r.Context()).Warn("unauthorized request", "authMode", mode, "claimedKeyId", identity, "error", err)
+			auditAuthFailure(r, identity, err.Error())
+			authFailuresTotal.WithLabelValues(mode).Inc()
+			writeError(w, r, http.StatusUnauthorized, "valid credentials are required")
+			return
+		}
+		next.ServeHTTP(w, withIdentity(r, identity))
 	})
 }
+
+// function to authenticate a request with the auth mode, returns the caller identity
+// in chained mode each authenticator is tried in order, the first one whose
+// credentials are present on the request decides the outcome
+func authenticateRequest(r *http.Request, mode string) (string, error) {
+	chain := []string{mode}
+	if mode == authModeChained {
+		chain = strings.Split(authChain, ",")
+	}
+	identity, err := "", errNoCredentials
+	for _, name := range chain {
+		identity, err = authenticators[strings.TrimSpace(name)](r)
+		if err != errNoCredentials {
+			break
+		}
+	}
+	return identity, err
+}
+
+// function to handle api key validation, bearer tokens are left to the JWT authenticator
+func authenticateAPIKey(r *http.Request) (string, error) {
+	apiKey := r.Header.Get("Authorization")
+	if apiKey == "" || strings.HasPrefix(apiKey, "Bearer ") {
+		return "", errNoCredentials
+	}
+	keyID, found := APIKeys[apiKey]
+	if !found {
+		return "", errors.New("invalid API key")
+	}
+	return keyID, nil
+}
+
+// prefix of JWT identities, so token subjects can never claim an API key ID such as an admin key
+const jwtIdentityPrefix = "jwt:"
+
+// function to validate a bearer JWT signed with the shared HS256 secret, the prefixed subject is the identity
+func authenticateJWT(r *http.Request) (string, error) {
+	tokenString, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		return "", errNoCredentials
+	}
+	// tokens signed with an empty key would otherwise be accepted
+	if jwtSecret == "" {
+		return "", errors.New("jwt authentication is not configured")
+	}
+	options := []jwt.ParserOption{jwt.WithValidMethods([]string{"HS256"}), jwt.WithExpirationRequired()}
+	if jwtIssuer != "" {
+		options = append(options, jwt.WithIssuer(jwtIssuer))
+	}
+	if jwtAudience != "" {
+		options = append(options, jwt.WithAudience(jwtAudience))
+	}
+	token, err := jwt.Parse(tokenString, func(*jwt.Token) (interface{}, error) {
+		return []byte(jwtSecret), nil
+	}, options...)
+	if err != nil {
+		return "", err
+	}
+	subject, err := token.Claims.GetSubject()
+	if err != nil || subject == "" {
+		return "", errors.New("token has no subject")
+	}
+	return jwtIdentityPrefix + subject, nil
+}
+
+// function to validate an HMAC-SHA256 signed request
+// signature covers the method, path, timestamp, nonce and a hash of the body,
+// timestamps outside of the allowed clock skew and reused nonces are rejected
+func authenticateHMAC(r *http.Request) (string, error) {
+	keyID := r.Header.Get(hmacKeyIDHeader)
+	timestamp := r.Header.Get(hmacTimestampHeader)
+	nonce := r.Header.Get(hmacNonceHeader)
+	signature := r.Header.Get(hmacSignatureHeader)
+	if signature == "" {
+		return "", errNoCredentials
+	}
+	if keyID == "" || timestamp == "" || nonce == "" {
+		return keyID, errors.New("missing signature headers")
+	}
+	secret, found := HMACSecrets[keyID]
+	if !found {
+		return keyID, errors.New("unknown key id " + keyID)
+	}
+
+	unixTime, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return keyID, errors.New("invalid timestamp " + timestamp)
+	}
+	skew := time.Since(time.Unix(unixTime, 0))
+	if skew > hmacMaxClockSkew || skew < -hmacMaxClockSkew {
+		return keyID, errors.New("timestamp outside allowed clock skew")
+	}
+
+	// read the body for hashing and restore it for the next handler
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return keyID, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	expected := computeHMACSignature(secret, r.Method, r.URL.Path, timestamp, nonce, body)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return keyID, errors.New("signature mismatch")
+	}
+	// only record the nonce once the signature is known to be valid
+	if !usedNonces.add(keyID+":"+nonce, 2*hmacMaxClockSkew) {
+		return keyID, errors.New("nonce already used")
+	}
+	return keyID, nil
+}
+
+// function to compute the hex encoded HMAC-SHA256 signature of a request
+func computeHMACSignature(secret, method, path, timestamp, nonce string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	canonical := strings.Join([]string{method, path, timestamp, nonce, hex.EncodeToString(bodyHash[:])}, "\n")
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// in memory cache of recently seen nonces, entries expire once the
+// timestamp they were sent with could no longer pass the clock skew check
+type nonceCache struct {
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastPrune time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{nonces: make(map[string]time.Time)}
+}
+
+// add records the nonce, returns false if it has already been seen
+func (c *nonceCache) add(nonce string, ttl time.Duration) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	c.pruneExpired(now)
+	// expired nonces waiting to be pruned can be reused
+	if expires, found := c.nonces[nonce]; found && !now.After(expires) {
+		return false
+	}
+	c.nonces[nonce] = now.Add(ttl)
+	return true
+}
+
+// pruneExpired drops expired nonces at most once a minute, caller must hold the lock
+func (c *nonceCache) pruneExpired(now time.Time) {
+	if now.Sub(c.lastPrune) < time.Minute {
+		return
+	}
+	c.lastPrune = now
+	for seen, expires := range c.nonces {
+		if now.After(expires) {
+			delete(c.nonces, seen)
+		}
+	}
+}
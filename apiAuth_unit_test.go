@@ -0,0 +1,251 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Helper function to build a signed request for the given secret
+func newSignedRequest(keyID, secret, nonce string, timestamp time.Time, body string) *http.Request {
+	req := httptest.NewRequest("POST", "/receipts/process", strings.NewReader(body))
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	req.Header.Set(hmacKeyIDHeader, keyID)
+	req.Header.Set(hmacTimestampHeader, ts)
+	req.Header.Set(hmacNonceHeader, nonce)
+	req.Header.Set(hmacSignatureHeader, computeHMACSignature(secret, req.Method, req.URL.Path, ts, nonce, []byte(body)))
+	return req
+}
+
+func TestValidateHMACSignature(t *testing.T) {
+	HMACSecrets["testpartner"] = "testsecret"
+	defer delete(HMACSecrets, "testpartner")
+
+	var handlerBody string
+	handler := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		handlerBody = string(b)
+	}))
+	body := `{"retailer":"Target"}`
+
+	// valid signature, body is still readable by the next handler
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newSignedRequest("testpartner", "testsecret", "nonce-1", time.Now(), body))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	if handlerBody != body {
+		t.Errorf("Expected body %q, got %q", body, handlerBody)
+	}
+
+	// replayed nonce
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, newSignedRequest("testpartner", "testsecret", "nonce-1", time.Now(), body))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	// wrong secret
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, newSignedRequest("testpartner", "wrongsecret", "nonce-2", time.Now(), body))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	// timestamp outside of clock skew
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, newSignedRequest("testpartner", "testsecret", "nonce-3", time.Now().Add(-time.Hour), body))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	// body tampered with after signing
+	rr = httptest.NewRecorder()
+	req := newSignedRequest("testpartner", "testsecret", "nonce-4", time.Now(), body)
+	req.Body = io.NopCloser(strings.NewReader(`{"retailer":"Other"}`))
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	// unknown key id
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, newSignedRequest("unknown", "testsecret", "nonce-5", time.Now(), body))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+func TestAuthModes(t *testing.T) {
+	hashAPIKeys([]string{"mode-key"})
+	jwtSecret = "test-jwt-secret"
+	defer func(savedRouteAuthModes string) {
+		authMode, routeAuthModes, jwtSecret = authModeChained, savedRouteAuthModes, ""
+	}(routeAuthModes)
+
+	newToken := func(secret string, expires time.Time) string {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "jwt-user", "exp": expires.Unix()}).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + token
+	}
+	validToken := newToken("test-jwt-secret", time.Now().Add(time.Hour))
+
+	testCases := []struct {
+		Name             string
+		AuthMode         string
+		RouteAuthModes   string
+		Path             string
+		Authorization    string
+		ExpectedStatus   int
+		ExpectedIdentity string
+	}{
+		{"none mode allows anonymous", authModeNone, "", "/receipts/process", "", http.StatusOK, ""},
+		{"apikey mode accepts key", authModeAPIKey, "", "/receipts/process", "mode-key", http.StatusOK, APIKeys["mode-key"]},
+		{"apikey mode rejects missing key", authModeAPIKey, "", "/receipts/process", "", http.StatusUnauthorized, ""},
+		{"apikey mode rejects bearer token", authModeAPIKey, "", "/receipts/process", validToken, http.StatusUnauthorized, ""},
+		{"jwt mode accepts token", authModeJWT, "", "/receipts/process", validToken, http.StatusOK, "jwt:jwt-user"},
+		{"jwt mode rejects wrong secret", authModeJWT, "", "/receipts/process", newToken("other", time.Now().Add(time.Hour)), http.StatusUnauthorized, ""},
+		{"jwt mode rejects expired token", authModeJWT, "", "/receipts/process", newToken("test-jwt-secret", time.Now().Add(-time.Hour)), http.StatusUnauthorized, ""},
+		{"chained mode falls through to api key", authModeChained, "", "/receipts/process", "mode-key", http.StatusOK, APIKeys["mode-key"]},
+		{"exact route override", authModeAPIKey, "/healthz=none", "/healthz", "", http.StatusOK, ""},
+		{"prefix route override", authModeNone, "/admin/*=apikey", "/admin/audit", "", http.StatusUnauthorized, ""},
+		{"override does not apply to other routes", authModeNone, "/admin/*=apikey", "/receipts/process", "", http.StatusOK, ""},
+	}
+
+	for _, tc := range testCases {
+		authMode, routeAuthModes = tc.AuthMode, tc.RouteAuthModes
+		var identity string
+		handler := authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity = identityFromRequest(r)
+		}))
+		req := httptest.NewRequest("GET", tc.Path, nil)
+		if tc.Authorization != "" {
+			req.Header.Set("Authorization", tc.Authorization)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != tc.ExpectedStatus {
+			t.Errorf("%s: expected status code %d, got %d", tc.Name, tc.ExpectedStatus, rr.Code)
+		}
+		if rr.Code == http.StatusOK && identity != tc.ExpectedIdentity {
+			t.Errorf("%s: expected identity %q, got %q", tc.Name, tc.ExpectedIdentity, identity)
+		}
+	}
+}
+
+func TestValidateAuthConfig(t *testing.T) {
+	defer func(savedRouteAuthModes string) {
+		authMode, routeAuthModes = authModeChained, savedRouteAuthModes
+	}(routeAuthModes)
+
+	authMode = "bogus"
+	if err := validateAuthConfig(); err == nil {
+		t.Errorf("Expected error for unknown auth mode")
+	}
+	authMode, routeAuthModes = authModeNone, "/admin/*=bogus"
+	if err := validateAuthConfig(); err == nil {
+		t.Errorf("Expected error for unknown route auth mode")
+	}
+	authMode, routeAuthModes = authModeJWT, ""
+	if err := validateAuthConfig(); err == nil {
+		t.Errorf("Expected error for jwt mode without a secret")
+	}
+	authMode = authModeChained
+	if err := validateAuthConfig(); err != nil {
+		t.Errorf("Expected default configuration to be valid, got %v", err)
+	}
+	defer func(savedAuthChain string) { authChain = savedAuthChain }(authChain)
+	authChain = "jwt,apikey"
+	if err := validateAuthConfig(); err == nil {
+		t.Errorf("Expected error for jwt in the auth chain without a secret")
+	}
+}
+
+func TestJWTIdentity(t *testing.T) {
+	hashAPIKeys([]string{"jwt-admin"})
+	adminID := APIKeys["jwt-admin"]
+	AdminKeyIDs[adminID] = true
+	defer delete(AdminKeyIDs, adminID)
+	newRequest := func(secret, subject string) *http.Request {
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": subject, "exp": time.Now().Add(time.Hour).Unix()}).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", "/admin/audit", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return req
+	}
+
+	// without a secret tokens signed with an empty key are rejected
+	if identity, err := authenticateJWT(newRequest("", "anything")); err == nil {
+		t.Errorf("Expected an error without a JWT secret, got identity %q", identity)
+	}
+
+	// subjects cannot claim an API key ID
+	jwtSecret = "test-jwt-secret"
+	defer func() { jwtSecret = "" }()
+	identity, err := authenticateJWT(newRequest(jwtSecret, adminID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity != "jwt:"+adminID || AdminKeyIDs[identity] {
+		t.Errorf("Expected a JWT identity that is not an admin key, got %q", identity)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	cache := newNonceCache()
+	if !cache.add("fresh", time.Minute) || cache.add("fresh", time.Minute) {
+		t.Errorf("Expected a nonce to be accepted once")
+	}
+
+	// expired nonces are accepted again before they are pruned
+	cache.add("expired", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if !cache.add("expired", time.Nanosecond) {
+		t.Errorf("Expected an expired nonce to be accepted again")
+	}
+	if len(cache.nonces) != 2 {
+		t.Errorf("Expected %d, got %d", 2, len(cache.nonces))
+	}
+
+	// pruning runs at most once a minute
+	time.Sleep(time.Millisecond)
+	cache.lastPrune = time.Now().Add(-time.Minute)
+	cache.add("other", time.Minute)
+	if _, found := cache.nonces["expired"]; found || len(cache.nonces) != 2 {
+		t.Errorf("Expected the expired nonce to be pruned, got %v", cache.nonces)
+	}
+}
+
+func TestHMACSecretsFlag(t *testing.T) {
+	saved := HMACSecrets
+	defer func() { HMACSecrets = saved }()
+
+	if err := (hmacSecretsFlag{}).Set("partner2=secret2, partner1=secret=1"); err != nil {
+		t.Fatalf("Error setting HMAC secrets: %v", err)
+	}
+	if HMACSecrets["partner1"] != "secret=1" || HMACSecrets["partner2"] != "secret2" {
+		t.Errorf("Unexpected secrets %v", HMACSecrets)
+	}
+	if value := (hmacSecretsFlag{}).String(); value != "partner1=secret=1,partner2=secret2" {
+		t.Errorf("Expected %s, got %s", "partner1=secret=1,partner2=secret2", value)
+	}
+	for _, value := range []string{"partner1", "=secret", "partner1="} {
+		if err := (hmacSecretsFlag{}).Set(value); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+	// invalid settings leave the secrets unchanged
+	if len(HMACSecrets) != 2 {
+		t.Errorf("Expected %d, got %d", 2, len(HMACSecrets))
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// admin key IDs allowed to call the admin endpoints, registered from -adminkeys
+var AdminKeyIDs = map[string]bool{}
+
+// command line flags
+var auditLogFileName string
+var adminKeys string
+
+// number of audit entries kept in memory for the admin endpoint, the audit log file keeps everything
+const maxAuditEntriesInMemory = 10000
+
+// function to register the comma separated -adminkeys as API keys allowed to call the admin endpoints
+// no admin keys are registered unless configured
+func registerAdminKeys(keys string) {
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		hashAPIKeys([]string{key})
+		AdminKeyIDs[APIKeys[key]] = true
+	}
+}
+
+// outcomes recorded in the audit log
+const (
+	auditOutcomeSuccess = "success"
+	auditOutcomeFailure = "failure"
+	auditOutcomeDenied  = "denied"
+)
+
+// single audit log record, who (key ID), what (action, route, receipt), when and the outcome
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	KeyID     string    `json:"keyId,omitempty"`
+	ClientIP  string    `json:"clientIp"`
+	Method    string    `json:"method"`
+	Route     string    `json:"route"`
+	Action    string    `json:"action"`
+	ReceiptID string    `json:"receiptId,omitempty"`
+	Status    int       `json:"status"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// append only audit log, entries are written as JSON lines to the audit file when configured
+type auditLog struct {
+	mu      sync.Mutex
+	entries []auditEntry
+	file    *os.File
+}
+
+var audit = &auditLog{}
+
+// function to open the audit log file for appending
+func (a *auditLog) openFile(fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.file = file
+	return nil
+}
+
+// function to flush and close the audit log file
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Sync()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	a.file = nil
+	return err
+}
+
+func (a *auditLog) record(entry auditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.entries = append(a.entries, entry)
+	if len(a.entries) > maxAuditEntriesInMemory {
+		a.entries = a.entries[len(a.entries)-maxAuditEntriesInMemory:]
+	}
+	if a.file != nil {
+		line, err := json.Marshal(entry)
+		if err == nil {
+			_, err = a.file.Write(append(line, '\n'))
+		}
+		if err != nil {
+			logger.Error("error writing audit entry", "error", err)
+		}
+	}
+}
+
+// filters for querying the audit log, empty values match everything
+type auditQuery struct {
+	KeyID   string
+	Action  string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+// function to return the entries matching the query, oldest first
+// when a limit is given the most recent matching entries are returned
+func (a *auditLog) query(q auditQuery) []auditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	matches := []auditEntry{}
+	for _, entry := range a.entries {
+		if (q.KeyID != "" && entry.KeyID != q.KeyID) ||
+			(q.Action != "" && entry.Action != q.Action) ||
+			(q.Outcome != "" && entry.Outcome != q.Outcome) ||
+			(!q.Since.IsZero() && entry.Time.Before(q.Since)) ||
+			(!q.Until.IsZero() && entry.Time.After(q.Until)) {
+			continue
+		}
+		matches = append(matches, entry)
+	}
+	if q.Limit > 0 && len(matches) > q.Limit {
+		matches = matches[len(matches)-q.Limit:]
+	}
+	return matches
+}
+
+const auditContextKey contextKey = "audit"
+
+// details filled in by handlers while serving a request
+type requestAudit struct {
+	receiptID string
+}
+
+// function to attach the receipt a request acted on to its audit entry
+func auditReceiptID(ctx context.Context, receiptID string) {
+	if details, ok := ctx.Value(auditContextKey).(*requestAudit); ok {
+		details.receiptID = receiptID
+	}
+}
+
+// function to build an audit entry for a request, action is the mux route name
+func newAuditEntry(r *http.Request) auditEntry {
+	entry := auditEntry{
+		Time:     time.Now().UTC(),
+		KeyID:    identityFromRequest(r),
+		ClientIP: clientIP(r),
+		Method:   r.Method,
+		Route:    r.URL.Path,
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		if template, err := route.GetPathTemplate(); err == nil {
+			entry.Route = template
+		}
+		entry.Action = route.GetName()
+	} else if action, found := grpcAuditActions[r.URL.Path]; found {
+		// gRPC calls are described by their full method name, see grpcHTTPRequest
+		entry.Action = action
+	}
+	entry.ReceiptID = mux.Vars(r)["id"]
+	return entry
+}
+
+// function to record an authentication failure
+func auditAuthFailure(r *http.Request, keyID string, reason string) {
+	entry := newAuditEntry(r)
+	entry.KeyID = keyID
+	entry.Status = http.StatusUnauthorized
+	entry.Outcome = auditOutcomeFailure
+	entry.Reason = reason
+	audit.record(entry)
+}
+
+// captures the status code written by the next handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(data []byte) (int, error) {
+	n, err := s.ResponseWriter.Write(data)
+	s.bytes += n
+	return n, err
+}
+
+// streamed responses such as Server-Sent Events are flushed through every recorder wrapping the writer
+func (s *statusRecorder) Flush() {
+	http.NewResponseController(s.ResponseWriter).Flush()
+}
+
+// lets http.ResponseController reach the underlying writer, e.g. to extend write deadlines
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// function to record every authenticated request in the audit log, must run after authentication
+// unauthenticated requests (auth mode none) are not recorded
+func auditRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if identityFromRequest(r) == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		details := &requestAudit{}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), auditContextKey, details)))
+
+		entry := newAuditEntry(r)
+		entry.Status = recorder.status
+		if details.receiptID != "" {
+			entry.ReceiptID = details.receiptID
+		}
+		switch {
+		case recorder.status == http.StatusUnauthorized || recorder.status == http.StatusForbidden:
+			entry.Outcome = auditOutcomeDenied
+		case recorder.status >= 400:
+			entry.Outcome = auditOutcomeFailure
+		default:
+			entry.Outcome = auditOutcomeSuccess
+		}
+		audit.record(entry)
+	})
+}
+
+// function to restrict routes to admin keys
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !AdminKeyIDs[identityFromRequest(r)] {
+			loggerFromContext(r.Context()).Warn("forbidden admin request")
+			writeError(w, r, http.StatusForbidden, "an admin key is required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// function to query the audit log
+// supports keyId, action, outcome, since, until (RFC 3339) and limit query parameters,
+// format=jsonl exports the matching entries as JSON lines
+func GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	q := auditQuery{
+		KeyID:   params.Get("keyId"),
+		Action:  params.Get("action"),
+		Outcome: params.Get("outcome"),
+	}
+	var err error
+	if since := params.Get("since"); since != "" {
+		if q.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			p := newProblem(http.StatusBadRequest, "invalid query parameter")
+			p.Errors = []fieldError{{Field: "since", Message: "must be an RFC 3339 time"}}
+			writeProblem(w, r, p)
+			return
+		}
+	}
+	if until := params.Get("until"); until != "" {
+		if q.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			p := newProblem(http.StatusBadRequest, "invalid query parameter")
+			p.Errors = []fieldError{{Field: "until", Message: "must be an RFC 3339 time"}}
+			writeProblem(w, r, p)
+			return
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 0 {
+			p := newProblem(http.StatusBadRequest, "invalid query parameter")
+			p.Errors = []fieldError{{Field: "limit", Message: "must be a non-negative integer"}}
+			writeProblem(w, r, p)
+			return
+		}
+	}
+	entries := audit.query(q)
+
+	if params.Get("format") == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		encoder := json.NewEncoder(w)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				loggerFromContext(r.Context()).Error("error encoding audit entry", "error", err)
+				return
+			}
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(entries)
+	if err != nil {
+		loggerFromContext(r.Context()).Error("error encoding audit log response", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	audit = &auditLog{}
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"audit-user", "audit-admin"})
+	userID, adminID := APIKeys["audit-user"], APIKeys["audit-admin"]
+	AdminKeyIDs[adminID] = true
+	defer delete(AdminKeyIDs, adminID)
+	router := newRouter()
+
+	// authenticated receipt processing, auth failure, forbidden admin call
+	rr := sendRequest(router, "POST", "/receipts/process", "audit-user", `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[],"total":"1.00"}`, nil)
+	var processed struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&processed); err != nil {
+		t.Fatal(err)
+	}
+	sendRequest(router, "GET", "/receipts/"+processed.ID+"/points", "bad-key", "", nil)
+	sendRequest(router, "GET", "/admin/audit", "audit-user", "", nil)
+
+	entries := audit.query(auditQuery{})
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 audit entries, got %d", len(entries))
+	}
+	expected := []auditEntry{
+		{KeyID: userID, Action: "receipt.process", Route: "/receipts/process", ReceiptID: processed.ID, Status: http.StatusOK, Outcome: auditOutcomeSuccess},
+		{KeyID: "", Action: "receipt.points", Route: "/receipts/{id}/points", ReceiptID: processed.ID, Status: http.StatusUnauthorized, Outcome: auditOutcomeFailure},
+		{KeyID: userID, Action: "admin.audit", Route: "/admin/audit", Status: http.StatusForbidden, Outcome: auditOutcomeDenied},
+	}
+	for i, e := range expected {
+		got := entries[i]
+		if got.KeyID != e.KeyID || got.Action != e.Action || got.Route != e.Route || got.ReceiptID != e.ReceiptID || got.Status != e.Status || got.Outcome != e.Outcome {
+			t.Errorf("Entry %d: expected %+v, got %+v", i, e, got)
+		}
+	}
+
+	// admin query filtered by key ID
+	rr = sendRequest(router, "GET", "/admin/audit?keyId="+userID, "audit-admin", "", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	var queried []auditEntry
+	if err := json.NewDecoder(rr.Body).Decode(&queried); err != nil {
+		t.Fatal(err)
+	}
+	if len(queried) != 2 {
+		t.Errorf("Expected 2 entries for %s, got %d", userID, len(queried))
+	}
+
+	// JSON lines export limited to the most recent entry (the previous admin query)
+	rr = sendRequest(router, "GET", "/admin/audit?format=jsonl&limit=1", "audit-admin", "", nil)
+	scanner := bufio.NewScanner(rr.Body)
+	lines := 0
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.KeyID != adminID {
+			t.Errorf("Expected key ID %s, got %s", adminID, entry.KeyID)
+		}
+		lines++
+	}
+	if lines != 1 {
+		t.Errorf("Expected 1 exported line, got %d", lines)
+	}
+
+	// invalid filter
+	rr = sendRequest(router, "GET", "/admin/audit?since=yesterday", "audit-admin", "", nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestRegisterAdminKeys(t *testing.T) {
+	registerAdminKeys(" admin-a,,admin-b ")
+	adminA, adminB := APIKeys["admin-a"], APIKeys["admin-b"]
+	defer func() {
+		delete(AdminKeyIDs, adminA)
+		delete(AdminKeyIDs, adminB)
+	}()
+	if adminA == "" || adminB == "" || !AdminKeyIDs[adminA] || !AdminKeyIDs[adminB] {
+		t.Errorf("Expected both keys to be registered as admin keys, got %v", AdminKeyIDs)
+	}
+}
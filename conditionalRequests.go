@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// function to return the strong entity tag of a receipt, it changes with every correction
+func receiptETag(receipt Receipt) string {
+	return `"` + receipt.ID + "." + strconv.Itoa(len(receipt.Revisions)+1) + `"`
+}
+
+// function to set the ETag and Last-Modified validators of a receipt on a response
+// receipts saved before modification times were recorded have no Last-Modified
+func setReceiptValidators(w http.ResponseWriter, receipt Receipt) {
+	w.Header().Set("ETag", receiptETag(receipt))
+	if !receipt.UpdatedAt.IsZero() {
+		w.Header().Set("Last-Modified", receipt.UpdatedAt.UTC().Format(http.TimeFormat))
+	}
+}
+
+// function to answer a conditional read of a receipt (If-None-Match, or If-Modified-Since without it)
+// sets the validators and writes 304 Not Modified, returning true, when the client's copy is current
+func receiptNotModified(w http.ResponseWriter, r *http.Request, receipt Receipt) bool {
+	setReceiptValidators(w, receipt)
+	notModified := false
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		notModified = etagListMatches(ifNoneMatch, receiptETag(receipt), false)
+	} else if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !receipt.UpdatedAt.IsZero() {
+		since, err := http.ParseTime(ifModifiedSince)
+		notModified = err == nil && !receipt.UpdatedAt.Truncate(time.Second).After(since)
+	}
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+	}
+	return notModified
+}
+
+// function to check the If-Match precondition of an update against the current receipt
+// writes 412 Precondition Failed and returns false when the receipt has changed since the client read it
+func receiptPreconditionMet(w http.ResponseWriter, r *http.Request, receipt Receipt) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" || etagListMatches(ifMatch, receiptETag(receipt), true) {
+		return true
+	}
+	loggerFromContext(r.Context()).Info("receipt update precondition failed", "receiptId", receipt.ID, "ifMatch", ifMatch)
+	w.Header().Set("ETag", receiptETag(receipt))
+	writeError(w, r, http.StatusPreconditionFailed, "receipt has been modified, its current ETag is "+receiptETag(receipt))
+	return false
+}
+
+// function to match an If-Match or If-None-Match header value against an entity tag
+// strong comparison (If-Match) never matches weak tags, weak comparison (If-None-Match) ignores the W/ prefix
+func etagListMatches(header string, etag string, strong bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if strong {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
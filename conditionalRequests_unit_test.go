@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConditionalRequests(t *testing.T) {
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"etag-user", "etag-admin"})
+	adminID := APIKeys["etag-admin"]
+	RateLimits[APIKeys["etag-user"]] = rateLimit{RequestsPerSecond: 1000, Burst: 1000}
+	defer delete(RateLimits, APIKeys["etag-user"])
+	AdminKeyIDs[adminID] = true
+	defer delete(AdminKeyIDs, adminID)
+	router := newRouter()
+
+	receipt := `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[{"shortDescription":"Mountain Dew 12PK","price":"6.49"}],"total":"6.49"}`
+
+	rr := sendRequest(router, "POST", "/v2/receipts/process", "etag-user", receipt, nil)
+	etag, lastModified := rr.Header().Get("ETag"), rr.Header().Get("Last-Modified")
+	if rr.Code != http.StatusCreated || etag == "" || lastModified == "" {
+		t.Fatalf("Expected status code %d with validators, got %d %q %q", http.StatusCreated, rr.Code, etag, lastModified)
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(rr.Header().Get("Location"), "/v2/receipts/"), "/points")
+	modifiedAt, _ := http.ParseTime(lastModified)
+
+	tests := []struct {
+		name           string
+		headers        map[string]string
+		expectedStatus int
+	}{
+		{"no validators", nil, http.StatusOK},
+		{"matching etag", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"weak matching etag", map[string]string{"If-None-Match": `"other", W/` + etag}, http.StatusNotModified},
+		{"any etag", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"other etag", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{"not modified since", map[string]string{"If-Modified-Since": lastModified}, http.StatusNotModified},
+		{"modified since", map[string]string{"If-Modified-Since": modifiedAt.Add(-time.Second).Format(http.TimeFormat)}, http.StatusOK},
+		{"etag takes precedence", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lastModified}, http.StatusOK},
+	}
+	for _, path := range []string{"/receipts/" + id + "/points", "/v1/receipts/" + id + "/points", "/v2/receipts/" + id + "/points", "/v2/receipts/" + id} {
+		for _, test := range tests {
+			rr := sendRequest(router, "GET", path, "etag-user", "", test.headers)
+			if rr.Code != test.expectedStatus {
+				t.Errorf("%s %s: expected status code %d, got %d", path, test.name, test.expectedStatus, rr.Code)
+			}
+			if rr.Header().Get("ETag") != etag || rr.Header().Get("Last-Modified") != lastModified {
+				t.Errorf("%s %s: expected validators %q %q, got %q %q", path, test.name, etag, lastModified, rr.Header().Get("ETag"), rr.Header().Get("Last-Modified"))
+			}
+			if rr.Code == http.StatusNotModified && rr.Body.Len() != 0 {
+				t.Errorf("%s %s: expected no body, got %q", path, test.name, rr.Body.String())
+			}
+		}
+	}
+
+	// updates are refused when the client's copy is stale
+	path := "/v2/receipts/" + id
+	rr = sendRequest(router, "PATCH", path, "etag-admin", `{"total":"7.00"}`, map[string]string{"If-Match": etag})
+	newETag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || newETag == "" || newETag == etag {
+		t.Fatalf("Expected status code %d with a new ETag, got %d %q", http.StatusOK, rr.Code, newETag)
+	}
+	for method, body := range map[string]string{"PUT": receipt, "PATCH": `{"total":"8.00"}`, "DELETE": `{"reason":"stale"}`} {
+		rr := sendRequest(router, method, path, "etag-admin", body, map[string]string{"If-Match": etag})
+		if rr.Code != http.StatusPreconditionFailed || rr.Header().Get("ETag") != newETag {
+			t.Errorf("%s: expected status code %d with the current ETag, got %d %q", method, http.StatusPreconditionFailed, rr.Code, rr.Header().Get("ETag"))
+		}
+	}
+	if rr := sendRequest(router, "GET", path, "etag-user", "", map[string]string{"If-None-Match": etag}); rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d for the stale ETag, got %d", http.StatusOK, rr.Code)
+	}
+	if rr := sendRequest(router, "PUT", path, "etag-admin", receipt, map[string]string{"If-Match": "W/" + newETag}); rr.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected status code %d for a weak ETag, got %d", http.StatusPreconditionFailed, rr.Code)
+	}
+	if rr := sendRequest(router, "DELETE", path, "etag-admin", `{"reason":"duplicate"}`, map[string]string{"If-Match": newETag}); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status code %d, got %d", http.StatusNoContent, rr.Code)
+	}
+}
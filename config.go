@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configuration is merged from a JSON config file, RECEIPTS_* environment variables and command line flags
+// flags take precedence over the environment, which takes precedence over the config file
+// every setting is a flag, the config file uses flag names as keys and the environment variable
+// is the flag name upper cased, e.g. -ratelimit can be set with "ratelimit" or RECEIPTS_RATELIMIT
+const configEnvPrefix = "RECEIPTS_"
+
+// command line flags
+var configFileName string
+var listenAddr = ":8080"
+
+// settings redacted by config print
+var secretSettings = map[string]bool{
+	"jwtsecret":   true,
+	"adminkeys":   true,
+	"hmacsecrets": true,
+}
+
+// function to register every setting as a flag on fs
+func registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&configFileName, "config", "", "JSON config file, also set with RECEIPTS_CONFIG")
+	fs.StringVar(&listenAddr, "listen", listenAddr, "Address the server listens on")
+	fs.StringVar(&grpcListenAddr, "grpclisten", grpcListenAddr, "Address the gRPC server listens on, empty disables it")
+	fs.BoolVar(&debugMode, "debug", false, "Run in debug mode, same as -loglevel debug")
+	fs.TextVar(logLevel, "loglevel", logLevel, "Minimum log level: debug, info, warn or error")
+	fs.BoolVar(&noAuthMode, "noauth", false, "Deprecated: same as -authmode none")
+	fs.StringVar(&authMode, "authmode", authMode, "Authentication mode: none, apikey, jwt, hmac, mtls or chained")
+	fs.StringVar(&authChain, "authchain", authChain, "Comma separated auth modes tried in order by the chained auth mode")
+	fs.StringVar(&routeAuthModes, "routeauth", routeAuthModes, "Per route auth mode overrides, e.g. /admin/*=apikey,/receipts/{id}/points=none")
+	fs.Var(hmacSecretsFlag{}, "hmacsecrets", "Shared secrets of partners signing requests, e.g. partner1=secret1,partner2=secret2, none by default")
+	fs.StringVar(&jwtSecret, "jwtsecret", "", "Shared HS256 secret used to verify JWT bearer tokens")
+	fs.StringVar(&jwtIssuer, "jwtissuer", "", "Required JWT issuer (iss) claim")
+	fs.StringVar(&jwtAudience, "jwtaudience", "", "Required JWT audience (aud) claim")
+	fs.BoolVar(&logToFile, "log", false, "Enable logging to a file")
+	fs.StringVar(&logFileName, "logfile", "logs/logfileAPI.log", "Override log file name")
+	fs.IntVar(&logMaxSizeMB, "logmaxsize", logMaxSizeMB, "Size in megabytes at which the log file is rotated")
+	fs.IntVar(&logMaxAgeDays, "logmaxage", logMaxAgeDays, "Days rotated log files are kept, 0 keeps them regardless of age")
+	fs.IntVar(&logMaxBackups, "logmaxbackups", logMaxBackups, "Number of rotated log files kept, 0 keeps all of them")
+	fs.BoolVar(&logCompress, "logcompress", logCompress, "Gzip compress rotated log files")
+	fs.DurationVar(&logRotateInterval, "logrotateevery", logRotateInterval, "Also rotate the log file on this interval, e.g. 24h, 0 disables")
+	fs.StringVar(&tlsCertFile, "tlscert", "", "Serve HTTPS using this certificate file")
+	fs.StringVar(&tlsKeyFile, "tlskey", "", "Private key file for the TLS certificate")
+	fs.StringVar(&tlsClientCAFile, "tlsclientca", "", "Verify client certificates against this CA when presented (mTLS), the mtls auth mode rejects requests without one")
+	fs.StringVar(&traceOutput, "traceoutput", "", "Export tracing spans to stdout or append them to this file")
+	fs.StringVar(&adminKeys, "adminkeys", "", "Comma separated API keys allowed to call the admin endpoints, none by default")
+	fs.StringVar(&auditLogFileName, "auditlog", "", "Append the audit log as JSON lines to this file")
+	fs.StringVar(&storeBackend, "store", storeBackend, "Receipt storage backend: memory or file")
+	fs.StringVar(&storeFileName, "storefile", storeFileName, "File used by the file storage backend")
+	fs.StringVar(&rulesFileName, "rulesfile", "", "JSON file selecting the enabled scoring rules and the rule set version")
+	fs.StringVar(&accessLogOutput, "accesslog", accessLogOutput, "Write the access log to stdout, stderr or append it to this file, empty disables it")
+	fs.StringVar(&accessLogFormat, "accesslogformat", accessLogFormat, "Access log format: combined or json")
+	fs.Int64Var(&maxBodyBytes, "maxbodybytes", maxBodyBytes, "Maximum request body size in bytes, larger requests are rejected with 413")
+	fs.IntVar(&maxReceiptItems, "maxitems", maxReceiptItems, "Maximum number of items per receipt")
+	fs.IntVar(&graphqlMaxDepth, "graphqlmaxdepth", graphqlMaxDepth, "Maximum depth of a GraphQL query")
+	fs.IntVar(&graphqlMaxComplexity, "graphqlmaxcomplexity", graphqlMaxComplexity, "Maximum complexity of a GraphQL query")
+	fs.TextVar(&legacySunsetAt, "legacysunset", legacySunsetAt, "Sunset date (RFC 3339) advertised on the deprecated unprefixed routes")
+	fs.DurationVar(&readTimeout, "readtimeout", readTimeout, "Maximum duration for reading an entire request")
+	fs.DurationVar(&readHeaderTimeout, "readheadertimeout", readHeaderTimeout, "Maximum duration for reading request headers")
+	fs.DurationVar(&writeTimeout, "writetimeout", writeTimeout, "Maximum duration before timing out writing a response")
+	fs.DurationVar(&idleTimeout, "idletimeout", idleTimeout, "Maximum time to wait for the next request on a keep-alive connection")
+	fs.DurationVar(&shutdownTimeout, "shutdowntimeout", shutdownTimeout, "Time allowed for in-flight requests to complete on SIGINT/SIGTERM")
+	fs.Float64Var(&defaultRateLimit.RequestsPerSecond, "ratelimit", defaultRateLimit.RequestsPerSecond, "Requests per second allowed per API key (per client IP when unauthenticated), 0 for unlimited")
+	fs.IntVar(&defaultRateLimit.Burst, "rateburst", defaultRateLimit.Burst, "Burst of requests allowed above the rate limit")
+	fs.IntVar(&defaultRateLimit.DailyQuota, "dailyquota", defaultRateLimit.DailyQuota, "Receipts that can be processed per API key per day, 0 for unlimited")
+	fs.Var(keyRateLimitsFlag{}, "keyratelimits", "Per key ID limits overriding the defaults, e.g. key-4e9091c123d8=50:100:0 (requests per second:burst:daily quota)")
+	fs.IntVar(&webhookMaxAttempts, "webhookmaxattempts", webhookMaxAttempts, "Webhook delivery attempts before an event is dead lettered")
+	fs.DurationVar(&webhookBackoff, "webhookbackoff", webhookBackoff, "Delay before retrying a failed webhook delivery, doubled after each attempt")
+	fs.DurationVar(&webhookTimeout, "webhooktimeout", webhookTimeout, "Timeout of a webhook delivery attempt")
+	fs.IntVar(&eventBufferSize, "eventbuffer", eventBufferSize, "Recent events kept for event stream clients resuming with Last-Event-ID")
+	fs.DurationVar(&eventHeartbeat, "eventheartbeat", eventHeartbeat, "Interval between heartbeats on idle event streams")
+}
+
+// function to parse the command line flags and merge in the config file and environment
+// settings given on the command line are never overridden
+func loadConfig(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	if !explicit["config"] {
+		configFileName = os.Getenv(configEnvPrefix + "CONFIG")
+	}
+	if configFileName != "" {
+		settings, err := readConfigFile(configFileName)
+		if err != nil {
+			return err
+		}
+		for name, value := range settings {
+			if name == "config" || explicit[name] {
+				continue
+			}
+			if err := setConfigValue(fs, name, value); err != nil {
+				return fmt.Errorf("config file %s: %w", configFileName, err)
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		value, found := os.LookupEnv(configEnvPrefix + strings.ToUpper(f.Name))
+		if !found || f.Name == "config" || explicit[f.Name] || err != nil {
+			return
+		}
+		if setErr := setConfigValue(fs, f.Name, value); setErr != nil {
+			err = fmt.Errorf("environment %s%s: %w", configEnvPrefix, strings.ToUpper(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// function to read a config file, a JSON object keyed by flag name
+// values can be strings, numbers or booleans
+func readConfigFile(fileName string) (map[string]string, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", fileName, err)
+	}
+	settings := make(map[string]string, len(raw))
+	for name, value := range raw {
+		switch value := value.(type) {
+		case float64:
+			// plain decimal, fmt.Sprint would use exponent notation for large integers such as 2097152
+			settings[name] = strconv.FormatFloat(value, 'f', -1, 64)
+		case string, bool:
+			settings[name] = fmt.Sprint(value)
+		default:
+			return nil, fmt.Errorf("config file %s: %s must be a string, number or boolean", fileName, name)
+		}
+	}
+	return settings, nil
+}
+
+// function to set a setting by flag name, rejecting unknown settings
+func setConfigValue(fs *flag.FlagSet, name string, value string) error {
+	if fs.Lookup(name) == nil {
+		return fmt.Errorf("unknown setting %q", name)
+	}
+	if err := fs.Set(name, value); err != nil {
+		return fmt.Errorf("invalid value %q for %s: %w", value, name, err)
+	}
+	return nil
+}
+
+// function to write the effective configuration as a JSON config file with secrets redacted
+func printConfig(w io.Writer, fs *flag.FlagSet) error {
+	settings := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		value := f.Value.String()
+		if secretSettings[f.Name] && value != "" {
+			value = "REDACTED"
+		}
+		settings[f.Name] = value
+	})
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// function to register the settings on a new flag set, restoring them once the test ends
+func newTestFlagSet(t *testing.T) *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	registerFlags(fs)
+	defaults := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) { defaults[f.Name] = f.Value.String() })
+	t.Cleanup(func() {
+		for name, value := range defaults {
+			fs.Set(name, value)
+		}
+	})
+	return fs
+}
+
+// function to test flags override the environment, which overrides the config file
+func TestLoadConfig(t *testing.T) {
+	fs := newTestFlagSet(t)
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(configFile, []byte(`{"listen": ":9000", "authmode": "apikey", "ratelimit": 2.5, "debug": true, "maxbodybytes": 2097152, "dailyquota": 1000000}`), 0644)
+	t.Setenv("RECEIPTS_CONFIG", configFile)
+	t.Setenv("RECEIPTS_AUTHMODE", "hmac")
+	t.Setenv("RECEIPTS_LISTEN", ":9100")
+
+	if err := loadConfig(fs, []string{"-listen", ":9200"}); err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	if listenAddr != ":9200" {
+		t.Errorf("Expected flag to win, got %s", listenAddr)
+	}
+	if authMode != authModeHMAC {
+		t.Errorf("Expected environment to override the config file, got %s", authMode)
+	}
+	if defaultRateLimit.RequestsPerSecond != 2.5 || !debugMode {
+		t.Errorf("Expected config file settings, got ratelimit %v debug %v", defaultRateLimit.RequestsPerSecond, debugMode)
+	}
+	// large integers are not read in exponent notation
+	if maxBodyBytes != 2097152 || defaultRateLimit.DailyQuota != 1000000 {
+		t.Errorf("Expected large integer settings, got maxbodybytes %d dailyquota %d", maxBodyBytes, defaultRateLimit.DailyQuota)
+	}
+}
+
+// function to test invalid settings are rejected
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]string{
+		"unknown setting": `{"bogus": "1"}`,
+		"invalid value":   `{"ratelimit": "fast"}`,
+		"nested value":    `{"authmode": {"mode": "apikey"}}`,
+		"invalid json":    `{"authmode": `,
+	}
+	for name, content := range tests {
+		fs := newTestFlagSet(t)
+		configFile := filepath.Join(dir, strings.ReplaceAll(name, " ", "_")+".json")
+		os.WriteFile(configFile, []byte(content), 0644)
+		if err := loadConfig(fs, []string{"-config", configFile}); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	fs := newTestFlagSet(t)
+	t.Setenv("RECEIPTS_DAILYQUOTA", "lots")
+	if err := loadConfig(fs, nil); err == nil {
+		t.Error("Expected an error for an invalid environment value")
+	}
+}
+
+// function to test config print redacts secrets and can be loaded back as a config file
+func TestPrintConfig(t *testing.T) {
+	fs := newTestFlagSet(t)
+	if err := loadConfig(fs, []string{"-jwtsecret", "top-secret", "-adminkeys", "admin-secret", "-hmacsecrets", "partner1=partner-secret", "-ratelimit", "3"}); err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	var output bytes.Buffer
+	if err := printConfig(&output, fs); err != nil {
+		t.Fatalf("Error printing config: %v", err)
+	}
+	if strings.Contains(output.String(), "top-secret") || strings.Contains(output.String(), "admin-secret") || strings.Contains(output.String(), "partner-secret") {
+		t.Error("Expected the JWT secret, admin keys and HMAC secrets to be redacted")
+	}
+	var settings map[string]string
+	if err := json.Unmarshal(output.Bytes(), &settings); err != nil {
+		t.Fatalf("Error decoding printed config: %v", err)
+	}
+	if settings["jwtsecret"] != "REDACTED" || settings["adminkeys"] != "REDACTED" || settings["hmacsecrets"] != "REDACTED" || settings["ratelimit"] != "3" || settings["listen"] != listenAddr {
+		t.Errorf("Unexpected printed config: %v", settings)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// header admin keys can send to log a single request at a different level, e.g. X-Log-Level: debug
+const logLevelHeader = "X-Log-Level"
+
+// log levels overriding the application log level for requests from a key ID
+var keyLogLevels = &keyLevels{levels: map[string]slog.Level{}}
+
+type keyLevels struct {
+	mu     sync.RWMutex
+	levels map[string]slog.Level
+}
+
+func (k *keyLevels) get(keyID string) (slog.Level, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	level, found := k.levels[keyID]
+	return level, found
+}
+
+func (k *keyLevels) set(keyID string, level *slog.Level) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if level == nil {
+		delete(k.levels, keyID)
+		return
+	}
+	k.levels[keyID] = *level
+}
+
+func (k *keyLevels) snapshot() map[string]string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	levels := make(map[string]string, len(k.levels))
+	for keyID, level := range k.levels {
+		levels[keyID] = level.String()
+	}
+	return levels
+}
+
+// function to apply per key and per request log levels to the request logger, must run after authentication
+// the X-Log-Level header is only honoured for admin keys so other callers can not flood the logs
+func requestLogLevels(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := identityFromRequest(r)
+		level, found := keyLogLevels.get(identity)
+		if header := r.Header.Get(logLevelHeader); header != "" && AdminKeyIDs[identity] {
+			found = level.UnmarshalText([]byte(header)) == nil
+		}
+		if found {
+			r = r.WithContext(withLogger(r.Context(), withLogLevel(loggerFromContext(r.Context()), level)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// log level settings returned and accepted by the admin endpoint
+type logLevelSettings struct {
+	Level     string            `json:"level"`
+	KeyLevels map[string]string `json:"keyLevels"`
+}
+
+// function to return the application log level and the per key overrides
+func GetLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, logLevelSettings{Level: logLevel.Level().String(), KeyLevels: keyLogLevels.snapshot()})
+}
+
+// function to change the log level at runtime, for the application or for a key ID
+// {"level":"debug"} sets the application level, {"keyId":"key-...","level":"debug"} sets the level
+// for requests from the key and {"keyId":"key-..."} removes the override
+func SetLogLevel(w http.ResponseWriter, r *http.Request) {
+	var change struct {
+		KeyID string `json:"keyId"`
+		Level string `json:"level"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&change); err != nil {
+		writeError(w, r, http.StatusBadRequest, decodeError(err).Message)
+		return
+	}
+	var level *slog.Level
+	if change.Level != "" || change.KeyID == "" {
+		level = new(slog.Level)
+		if err := level.UnmarshalText([]byte(change.Level)); err != nil {
+			p := newProblem(http.StatusBadRequest, "invalid log level")
+			p.Errors = []fieldError{{Field: "level", Message: "must be one of debug, info, warn or error"}}
+			writeProblem(w, r, p)
+			return
+		}
+	}
+
+	if change.KeyID == "" {
+		logLevel.Set(*level)
+	} else {
+		keyLogLevels.set(change.KeyID, level)
+	}
+	loggerFromContext(r.Context()).Warn("log level changed", "targetKeyId", change.KeyID, "level", change.Level)
+	GetLogLevel(w, r)
+}
+
+// function to mount the pprof profiling handlers, pprof expects to be served from /debug/pprof/
+func handlePprof(admin *mux.Router) {
+	admin.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline).Methods("GET").Name("admin.pprof.cmdline")
+	admin.HandleFunc("/debug/pprof/profile", pprof.Profile).Methods("GET").Name("admin.pprof.profile")
+	admin.HandleFunc("/debug/pprof/symbol", pprof.Symbol).Methods("GET", "POST").Name("admin.pprof.symbol")
+	admin.HandleFunc("/debug/pprof/trace", pprof.Trace).Methods("GET").Name("admin.pprof.trace")
+	admin.PathPrefix("/debug/pprof/").Handler(http.StripPrefix("/admin", http.HandlerFunc(pprof.Index))).Methods("GET").Name("admin.pprof")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRuntimeLogLevels(t *testing.T) {
+	var output bytes.Buffer
+	savedLogger, savedLevel := logger, logLevel.Level()
+	logger = newLogger(&output)
+	defer func() { logger = savedLogger; logLevel.Set(savedLevel) }()
+	logLevel.Set(slog.LevelInfo)
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"level-user", "level-other", "level-admin"})
+	userID, otherID, adminID := APIKeys["level-user"], APIKeys["level-other"], APIKeys["level-admin"]
+	AdminKeyIDs[adminID] = true
+	defer delete(AdminKeyIDs, adminID)
+	defer keyLogLevels.set(userID, nil)
+	router := newRouter()
+
+	receipt := `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[],"total":"1.00"}`
+	// function to count the debug lines logged for a key ID since the last call
+	debugLines := func(keyID string) int {
+		lines := 0
+		for _, line := range strings.Split(output.String(), "\n") {
+			if strings.Contains(line, `"level":"DEBUG"`) && strings.Contains(line, `"keyId":"`+keyID+`"`) {
+				lines++
+			}
+		}
+		output.Reset()
+		return lines
+	}
+
+	// only admin keys can change the log level
+	rr := sendRequest(router, "PUT", "/admin/loglevel", "level-user", `{"level":"debug"}`, nil)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, got %d", http.StatusForbidden, rr.Code)
+	}
+	rr = sendRequest(router, "PUT", "/admin/loglevel", "level-admin", `{"level":"loud"}`, nil)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	// per key level
+	rr = sendRequest(router, "PUT", "/admin/loglevel", "level-admin", `{"keyId":"`+userID+`","level":"debug"}`, nil)
+	var settings logLevelSettings
+	json.NewDecoder(rr.Body).Decode(&settings)
+	if rr.Code != http.StatusOK || settings.Level != "INFO" || settings.KeyLevels[userID] != "DEBUG" {
+		t.Errorf("Unexpected log level settings %d %+v", rr.Code, settings)
+	}
+	output.Reset()
+	sendRequest(router, "POST", "/receipts/process", "level-user", receipt, nil)
+	if debugLines(userID) == 0 {
+		t.Error("Expected debug logs for the key with a debug level")
+	}
+	sendRequest(router, "POST", "/receipts/process", "level-other", receipt, nil)
+	if lines := debugLines(otherID); lines != 0 {
+		t.Errorf("Expected %d, got %d", 0, lines)
+	}
+
+	// per request header, only honoured for admin keys
+	sendRequest(router, "POST", "/receipts/process", "level-other", receipt, map[string]string{logLevelHeader: "debug"})
+	if lines := debugLines(otherID); lines != 0 {
+		t.Errorf("Expected %d, got %d", 0, lines)
+	}
+	sendRequest(router, "POST", "/receipts/process", "level-admin", receipt, map[string]string{logLevelHeader: "debug"})
+	if debugLines(adminID) == 0 {
+		t.Error("Expected debug logs for an admin request with the log level header")
+	}
+
+	// removing the key override and changing the application level
+	sendRequest(router, "PUT", "/admin/loglevel", "level-admin", `{"keyId":"`+userID+`"}`, nil)
+	sendRequest(router, "PUT", "/admin/loglevel", "level-admin", `{"level":"debug"}`, nil)
+	rr = sendRequest(router, "GET", "/admin/loglevel", "level-admin", "", nil)
+	settings = logLevelSettings{}
+	json.NewDecoder(rr.Body).Decode(&settings)
+	if settings.Level != "DEBUG" || len(settings.KeyLevels) != 0 || logLevel.Level() != slog.LevelDebug {
+		t.Errorf("Unexpected log level settings %+v", settings)
+	}
+}
+
+func TestPprofEndpoints(t *testing.T) {
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"pprof-user", "pprof-admin"})
+	AdminKeyIDs[APIKeys["pprof-admin"]] = true
+	defer delete(AdminKeyIDs, APIKeys["pprof-admin"])
+	router := newRouter()
+
+	tests := []struct {
+		path           string
+		apiKey         string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"/admin/debug/pprof/", "pprof-admin", http.StatusOK, "goroutine"},
+		{"/admin/debug/pprof/heap?debug=1", "pprof-admin", http.StatusOK, "heap profile"},
+		{"/admin/debug/pprof/cmdline", "pprof-admin", http.StatusOK, ""},
+		{"/admin/debug/pprof/heap?debug=1", "pprof-user", http.StatusForbidden, ""},
+		{"/admin/debug/pprof/", "", http.StatusUnauthorized, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		req.Header.Set("Authorization", test.apiKey)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != test.expectedStatus {
+			t.Errorf("%s: expected status code %d, got %d", test.path, test.expectedStatus, rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), test.expectedBody) {
+			t.Errorf("%s: expected body containing %q", test.path, test.expectedBody)
+		}
+	}
+}
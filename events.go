@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// command line flags
+var eventBufferSize = 1000
+var eventHeartbeat = 15 * time.Second
+
+// events queued for a stream before it is considered too slow and disconnected,
+// the client resumes from the buffer when it reconnects
+const eventSubscriberQueueSize = 100
+
+// receipts rejected by validation, only sent on the event stream as they have no receipt
+const eventReceiptRejected = "receipt.rejected"
+
+// event sent on the event stream, IDs increase by one for each event published by the process
+type streamEvent struct {
+	ID        uint64    `json:"id"`
+	Type      string    `json:"type"`
+	Tenant    string    `json:"tenant"`
+	CreatedAt time.Time `json:"createdAt"`
+	Data      any       `json:"data"`
+}
+
+// data of receipt.rejected events, the message is the one returned to the client
+type receiptRejection struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	Field   string `json:"field,omitempty"`
+}
+
+type eventSubscriber struct {
+	tenant string // empty for every tenant
+	queue  chan streamEvent
+}
+
+func (s *eventSubscriber) receives(event streamEvent) bool {
+	return s.tenant == "" || s.tenant == event.Tenant
+}
+
+// fans published events out to the connected streams, the most recent eventBufferSize
+// events are kept so disconnected clients can resume, events from before a restart are lost
+type eventBroker struct {
+	mu          sync.Mutex
+	lastID      uint64
+	buffer      []streamEvent
+	subscribers map[*eventSubscriber]bool
+}
+
+var receiptEvents = newEventBroker()
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{subscribers: map[*eventSubscriber]bool{}}
+}
+
+// function to buffer an event and send it to every stream of its tenant, never blocks the caller
+func (b *eventBroker) publish(tenant string, eventType string, data any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastID++
+	event := streamEvent{ID: b.lastID, Type: eventType, Tenant: tenant, CreatedAt: time.Now().UTC(), Data: data}
+	b.buffer = append(b.buffer, event)
+	if size := max(eventBufferSize, 0); len(b.buffer) > size {
+		b.buffer = b.buffer[len(b.buffer)-size:]
+	}
+	for subscriber := range b.subscribers {
+		if !subscriber.receives(event) {
+			continue
+		}
+		select {
+		case subscriber.queue <- event:
+		default:
+			logger.Warn("disconnecting slow event stream", "tenant", subscriber.tenant)
+			b.remove(subscriber)
+		}
+	}
+}
+
+// function to open a stream of events for the tenant, with the buffered events published after lastEventID
+// an ID the buffer does not reach back to, or from before a restart, replays the whole buffer
+func (b *eventBroker) subscribe(tenant string, lastEventID uint64, resume bool) (*eventSubscriber, []streamEvent) {
+	subscriber := &eventSubscriber{tenant: tenant, queue: make(chan streamEvent, eventSubscriberQueueSize)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var replay []streamEvent
+	if resume {
+		if lastEventID > b.lastID {
+			lastEventID = 0
+		}
+		for _, event := range b.buffer {
+			if event.ID > lastEventID && subscriber.receives(event) {
+				replay = append(replay, event)
+			}
+		}
+	}
+	b.subscribers[subscriber] = true
+	return subscriber, replay
+}
+
+// function to stop sending events to a stream, must hold b.mu
+func (b *eventBroker) remove(subscriber *eventSubscriber) {
+	if b.subscribers[subscriber] {
+		delete(b.subscribers, subscriber)
+		close(subscriber.queue)
+	}
+}
+
+func (b *eventBroker) unsubscribe(subscriber *eventSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(subscriber)
+}
+
+// function to end every open stream, so they do not hold up draining the server on shutdown
+func (b *eventBroker) disconnectAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for subscriber := range b.subscribers {
+		b.remove(subscriber)
+	}
+}
+
+// function to publish a receipt rejected by validation, tenant is the caller's identity
+func publishReceiptRejected(tenant string, requestErr *requestError) {
+	receiptEvents.publish(tenant, eventReceiptRejected, receiptRejection{Status: requestErr.Status, Message: requestErr.Message, Field: requestErr.Field})
+}
+
+// function to stream receipt events as Server-Sent Events
+// admin keys receive every tenant's events, or one tenant's with ?tenant=, other keys only receive their own
+// when the route is not authenticated (auth mode none) every caller is treated like an admin key
+// clients reconnecting with Last-Event-ID are sent the buffered events they missed
+func StreamEvents(w http.ResponseWriter, r *http.Request) {
+	identity := identityFromRequest(r)
+	tenant := r.URL.Query().Get("tenant")
+	if identity != "" && !AdminKeyIDs[identity] {
+		if tenant != "" && tenant != identity {
+			writeError(w, r, http.StatusForbidden, "an admin key is required to stream another tenant's events")
+			return
+		}
+		tenant = identity
+	}
+	var lastEventID uint64
+	header := r.Header.Get("Last-Event-ID")
+	resume := header != ""
+	if resume {
+		var err error
+		if lastEventID, err = strconv.ParseUint(header, 10, 64); err != nil {
+			writeError(w, r, http.StatusBadRequest, "Last-Event-ID must be an event ID")
+			return
+		}
+	}
+
+	controller := http.NewResponseController(w)
+	// streams outlive the server write timeout, not supported when testing with a recorder
+	_ = controller.SetWriteDeadline(time.Time{})
+	subscriber, replay := receiptEvents.subscribe(tenant, lastEventID, resume)
+	defer receiptEvents.unsubscribe(subscriber)
+	eventStreamsOpen.Inc()
+	defer eventStreamsOpen.Dec()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// stops nginx buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range replay {
+		if err := writeStreamEvent(w, event); err != nil {
+			return
+		}
+	}
+	if err := controller.Flush(); err != nil {
+		loggerFromContext(r.Context()).Error("event stream cannot be flushed", "error", err)
+		return
+	}
+
+	// a heartbeat of 0 disables heartbeats
+	var heartbeats <-chan time.Time
+	if eventHeartbeat > 0 {
+		heartbeat := time.NewTicker(eventHeartbeat)
+		defer heartbeat.Stop()
+		heartbeats = heartbeat.C
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, open := <-subscriber.queue:
+			if !open {
+				return
+			}
+			if err := writeStreamEvent(w, event); err != nil {
+				return
+			}
+		case <-heartbeats:
+			// comments are ignored by clients but keep proxies from closing an idle stream
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// function to write an event in the text/event-stream format
+func writeStreamEvent(w http.ResponseWriter, event streamEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// function to read the next event from a stream, skipping comments such as heartbeats
+func nextStreamEvent(t *testing.T, reader *bufio.Reader) streamEvent {
+	t.Helper()
+	var event streamEvent
+	var id uint64
+	var eventType string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && eventType != "":
+			if event.ID != id || event.Type != eventType {
+				t.Errorf("Expected the id and event fields to match the data, got %d %s %+v", id, eventType, event)
+			}
+			return event
+		case strings.HasPrefix(line, "id: "):
+			id, _ = strconv.ParseUint(strings.TrimPrefix(line, "id: "), 10, 64)
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				t.Fatalf("Error decoding event data: %v", err)
+			}
+		}
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"events-user", "events-other", "events-admin"})
+	tenant, adminID := APIKeys["events-user"], APIKeys["events-admin"]
+	AdminKeyIDs[adminID] = true
+	savedEvents := receiptEvents
+	receiptEvents = newEventBroker()
+	defer func() {
+		receiptEvents = savedEvents
+		delete(AdminKeyIDs, adminID)
+	}()
+	router := newRouter()
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	stream := func(path, apiKey, lastEventID string) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Header.Set("Authorization", apiKey)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	adminStream := stream("/events", "events-admin", "")
+	defer adminStream.Body.Close()
+	if adminStream.StatusCode != http.StatusOK || adminStream.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected status code %d with an event stream, got %d %s", http.StatusOK, adminStream.StatusCode, adminStream.Header.Get("Content-Type"))
+	}
+	tenantStream := stream("/events", "events-user", "")
+	defer tenantStream.Body.Close()
+
+	sendRequest(router, "POST", "/v2/receipts/process", "events-other", `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[],"total":"6.49"}`, nil)
+	sendRequest(router, "POST", "/v2/receipts/process", "events-user", `{"retailer":"Target","coupon":"FREE"}`, nil)
+	sendRequest(router, "POST", "/v2/receipts/process", "events-user", `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[],"total":"abc"}`, nil)
+
+	// admins receive every tenant's events in order
+	admin := bufio.NewReader(adminStream.Body)
+	expected := []struct {
+		eventType string
+		tenant    string
+	}{
+		{eventReceiptProcessed, APIKeys["events-other"]},
+		{eventReceiptRejected, tenant},
+		{eventReceiptProcessed, tenant},
+		{eventReceiptFlagged, tenant},
+	}
+	for i, test := range expected {
+		event := nextStreamEvent(t, admin)
+		if event.ID != uint64(i+1) || event.Type != test.eventType || event.Tenant != test.tenant {
+			t.Errorf("Expected event %d %s for %s, got %+v", i+1, test.eventType, test.tenant, event)
+		}
+	}
+
+	// other keys only receive their own events
+	own := bufio.NewReader(tenantStream.Body)
+	rejected := nextStreamEvent(t, own)
+	data, _ := rejected.Data.(map[string]any)
+	if rejected.Type != eventReceiptRejected || data["status"] != float64(http.StatusBadRequest) || data["field"] != "coupon" {
+		t.Errorf("Unexpected rejected event %+v", rejected)
+	}
+	if event := nextStreamEvent(t, own); event.ID != 3 || event.Type != eventReceiptProcessed {
+		t.Errorf("Expected the tenant's processed event, got %+v", event)
+	}
+
+	// reconnecting with Last-Event-ID resumes from the buffer
+	resumed := stream("/events?tenant="+tenant, "events-admin", "2")
+	defer resumed.Body.Close()
+	resumedReader := bufio.NewReader(resumed.Body)
+	for _, expectedID := range []uint64{3, 4} {
+		if event := nextStreamEvent(t, resumedReader); event.ID != expectedID || event.Tenant != tenant {
+			t.Errorf("Expected resumed event %d, got %+v", expectedID, event)
+		}
+	}
+
+	for _, test := range []struct {
+		path           string
+		apiKey         string
+		lastEventID    string
+		expectedStatus int
+	}{
+		{"/events?tenant=" + APIKeys["events-other"], "events-user", "", http.StatusForbidden},
+		{"/events", "events-user", "abc", http.StatusBadRequest},
+		{"/events", "bad-key", "", http.StatusUnauthorized},
+	} {
+		resp := stream(test.path, test.apiKey, test.lastEventID)
+		resp.Body.Close()
+		if resp.StatusCode != test.expectedStatus {
+			t.Errorf("%s: expected status code %d, got %d", test.path, test.expectedStatus, resp.StatusCode)
+		}
+	}
+
+	// without authentication any tenant can be selected
+	savedRouteAuthModes := routeAuthModes
+	routeAuthModes += ",/events=none"
+	defer func() { routeAuthModes = savedRouteAuthModes }()
+	public := httptest.NewServer(newRouter())
+	defer public.Close()
+	req, _ := http.NewRequest("GET", public.URL+"/events?tenant="+APIKeys["events-other"], nil)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	// the one event of the tenant is replayed, the stream then waits for the next receipt
+	sendRequest(router, "POST", "/v2/receipts/process", "events-user", `{"retailer":"Target","coupon":"FREE"}`, nil)
+	sendRequest(router, "POST", "/v2/receipts/process", "events-other", `{"retailer":"Target","coupon":"FREE"}`, nil)
+	unauthenticated := bufio.NewReader(resp.Body)
+	for _, expectedID := range []uint64{1, 6} {
+		if event := nextStreamEvent(t, unauthenticated); event.ID != expectedID || event.Tenant != APIKeys["events-other"] {
+			t.Errorf("Expected event %d of the selected tenant, got %+v", expectedID, event)
+		}
+	}
+}
+
+func TestStreamEventsHeartbeat(t *testing.T) {
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"events-user"})
+	savedEvents, savedHeartbeat := receiptEvents, eventHeartbeat
+	receiptEvents, eventHeartbeat = newEventBroker(), 10*time.Millisecond
+	defer func() { receiptEvents, eventHeartbeat = savedEvents, savedHeartbeat }()
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/events", nil)
+	req.Header.Set("Authorization", "events-user")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != ": heartbeat\n" {
+		t.Errorf("Expected a heartbeat comment, got %q %v", line, err)
+	}
+
+	// streams are ended on shutdown
+	receiptEvents.disconnectAll()
+	if !waitFor(time.Second, func() bool {
+		receiptEvents.mu.Lock()
+		defer receiptEvents.mu.Unlock()
+		return len(receiptEvents.subscribers) == 0
+	}) {
+		t.Errorf("Expected the stream to be disconnected")
+	}
+}
+
+func TestEventBroker(t *testing.T) {
+	savedBufferSize := eventBufferSize
+	eventBufferSize = 3
+	defer func() { eventBufferSize = savedBufferSize }()
+	broker := newEventBroker()
+	for i := 0; i < 5; i++ {
+		broker.publish("tenant", eventReceiptProcessed, receiptEventData{})
+	}
+
+	// the buffer keeps the most recent events
+	for _, test := range []struct {
+		lastEventID uint64
+		expectedIDs []uint64
+	}{
+		{4, []uint64{5}},
+		{1, []uint64{3, 4, 5}},
+		{5, nil},
+		// from before a restart
+		{100, []uint64{3, 4, 5}},
+	} {
+		subscriber, replay := broker.subscribe("", test.lastEventID, true)
+		broker.unsubscribe(subscriber)
+		var ids []uint64
+		for _, event := range replay {
+			ids = append(ids, event.ID)
+		}
+		if len(ids) != len(test.expectedIDs) || (len(ids) > 0 && (ids[0] != test.expectedIDs[0] || ids[len(ids)-1] != test.expectedIDs[len(test.expectedIDs)-1])) {
+			t.Errorf("Last-Event-ID %d: expected %v, got %v", test.lastEventID, test.expectedIDs, ids)
+		}
+	}
+
+	// slow streams are disconnected rather than blocking publishers
+	slow, _ := broker.subscribe("tenant", 0, false)
+	other, _ := broker.subscribe("other", 0, false)
+	for i := 0; i <= eventSubscriberQueueSize; i++ {
+		broker.publish("tenant", eventReceiptProcessed, receiptEventData{})
+	}
+	received := 0
+	for range slow.queue {
+		received++
+	}
+	if received != eventSubscriberQueueSize {
+		t.Errorf("Expected %d events before disconnecting, got %d", eventSubscriberQueueSize, received)
+	}
+	broker.mu.Lock()
+	if broker.subscribers[slow] || !broker.subscribers[other] || len(other.queue) != 0 {
+		t.Errorf("Expected only the slow stream to be disconnected")
+	}
+	broker.mu.Unlock()
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+)
+
+// command line flags
+var graphqlMaxDepth = 10
+var graphqlMaxComplexity = 1000
+
+// number of receipts returned by the receipts query when no limit is given, and the largest limit accepted
+const (
+	graphqlDefaultLimit = 20
+	graphqlMaxLimit     = 100
+)
+
+// aggregate points of the receipts from one retailer
+type retailerStats struct {
+	Retailer      string  `json:"retailer"`
+	Receipts      int     `json:"receipts"`
+	TotalPoints   int     `json:"totalPoints"`
+	AveragePoints float64 `json:"averagePoints"`
+	MaxPoints     int     `json:"maxPoints"`
+}
+
+var graphqlItemType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Item",
+	Fields: graphql.Fields{
+		"shortDescription": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"price":            &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+	},
+})
+
+var graphqlRuleScoreType = graphql.NewObject(graphql.ObjectConfig{
+	Name:        "RuleScore",
+	Description: "Points awarded to a receipt by one scoring rule",
+	Fields: graphql.Fields{
+		"rule":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"points": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+	},
+})
+
+var graphqlReceiptType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Receipt",
+	Fields: graphql.Fields{
+		"id":           &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+		"retailer":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"purchaseDate": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"purchaseTime": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"total":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"points":       &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"calculationError": &graphql.Field{
+			Type:        graphql.NewNonNull(graphql.Boolean),
+			Description: "Whether some of the receipt data could not be scored, the points are still totalled from the rules that could be applied",
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return p.Source.(Receipt).CalulationErr, nil
+			},
+		},
+		"items": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphqlItemType))),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return append([]Item{}, p.Source.(Receipt).Items...), nil
+			},
+		},
+		"breakdown": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphqlRuleScoreType))),
+			Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+				return append([]ruleScore{}, p.Source.(Receipt).Breakdown...), nil
+			},
+		},
+	},
+})
+
+var graphqlRetailerStatsType = graphql.NewObject(graphql.ObjectConfig{
+	Name:        "RetailerStats",
+	Description: "Aggregate points of the receipts from one retailer",
+	Fields: graphql.Fields{
+		"retailer":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		"receipts":      &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"totalPoints":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		"averagePoints": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+		"maxPoints":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+	},
+})
+
+var graphqlQueryType = graphql.NewObject(graphql.ObjectConfig{
+	Name: "Query",
+	Fields: graphql.Fields{
+		"receipt": &graphql.Field{
+			Type: graphqlReceiptType,
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+			},
+			Resolve: resolveReceipt,
+		},
+		"receipts": &graphql.Field{
+			Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphqlReceiptType))),
+			Description: "Receipts ordered by ID, optionally only those from one retailer",
+			Args: graphql.FieldConfigArgument{
+				"retailer": &graphql.ArgumentConfig{Type: graphql.String},
+				"limit":    &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: graphqlDefaultLimit},
+				"offset":   &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: 0},
+			},
+			Resolve: resolveReceipts,
+		},
+		"retailerStats": &graphql.Field{
+			Type:        graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphqlRetailerStatsType))),
+			Description: "Points aggregated per retailer, ordered by retailer",
+			Args: graphql.FieldConfigArgument{
+				"retailer": &graphql.ArgumentConfig{Type: graphql.String},
+			},
+			Resolve: resolveRetailerStats,
+		},
+	},
+})
+
+var graphqlSchema = func() graphql.Schema {
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: graphqlQueryType})
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}()
+
+func resolveReceipt(p graphql.ResolveParams) (interface{}, error) {
+	id, _ := p.Args["id"].(string)
+	_, span := startStoreSpan(p.Context, "get", id)
+	receipt, found := store.Get(id)
+	span.End()
+	if !found || receipt.Deleted != nil || !receiptVisibleTo(p.Context, receipt) {
+		return nil, nil
+	}
+	return receipt, nil
+}
+
+func resolveReceipts(p graphql.ResolveParams) (interface{}, error) {
+	limit, _ := p.Args["limit"].(int)
+	offset, _ := p.Args["offset"].(int)
+	if limit < 1 || limit > graphqlMaxLimit {
+		return nil, fmt.Errorf("limit must be between 1 and %d", graphqlMaxLimit)
+	}
+	if offset < 0 {
+		return nil, errors.New("offset must not be negative")
+	}
+	receipts := retailerReceipts(p.Context, p.Args["retailer"])
+	sort.Slice(receipts, func(i, j int) bool { return receipts[i].ID < receipts[j].ID })
+	if offset >= len(receipts) {
+		return []Receipt{}, nil
+	}
+	receipts = receipts[offset:]
+	if len(receipts) > limit {
+		receipts = receipts[:limit]
+	}
+	return receipts, nil
+}
+
+func resolveRetailerStats(p graphql.ResolveParams) (interface{}, error) {
+	byRetailer := map[string]*retailerStats{}
+	for _, receipt := range retailerReceipts(p.Context, p.Args["retailer"]) {
+		stats, ok := byRetailer[receipt.Retailer]
+		if !ok {
+			stats = &retailerStats{Retailer: receipt.Retailer}
+			byRetailer[receipt.Retailer] = stats
+		}
+		stats.Receipts++
+		stats.TotalPoints += receipt.Points
+		stats.MaxPoints = max(stats.MaxPoints, receipt.Points)
+	}
+	results := make([]retailerStats, 0, len(byRetailer))
+	for _, stats := range byRetailer {
+		stats.AveragePoints = float64(stats.TotalPoints) / float64(stats.Receipts)
+		results = append(results, *stats)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Retailer < results[j].Retailer })
+	return results, nil
+}
+
+// function to list the receipts the caller can read that have not been deleted, only those from the retailer when one is given
+func retailerReceipts(ctx context.Context, retailer interface{}) []Receipt {
+	_, span := startStoreSpan(ctx, "list", "")
+	receipts := store.List()
+	span.End()
+	name, filtered := retailer.(string)
+	matches := []Receipt{}
+	for _, receipt := range receipts {
+		if receipt.Deleted == nil && receiptVisibleTo(ctx, receipt) && (!filtered || receipt.Retailer == name) {
+			matches = append(matches, receipt)
+		}
+	}
+	return matches
+}
+
+// body of a GraphQL request
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// function to handle GraphQL queries over receipts, points and per retailer aggregates
+// queries that cannot be executed (syntax, validation or query cost errors) are answered with 400
+func GraphQL(w http.ResponseWriter, r *http.Request) {
+	var req graphqlRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, bodyTooLargeMessage())
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, "request body must be a JSON object with a query")
+		return
+	}
+
+	document, errs := parseGraphQL(req)
+	if len(errs) > 0 {
+		loggerFromContext(r.Context()).Info("rejected GraphQL query", "errors", errs)
+		writeJSON(w, r, http.StatusBadRequest, &graphql.Result{Errors: errs})
+		return
+	}
+	result := graphql.Execute(graphql.ExecuteParams{
+		Schema:        graphqlSchema,
+		AST:           document,
+		OperationName: req.OperationName,
+		Args:          req.Variables,
+		Context:       r.Context(),
+	})
+	writeJSON(w, r, http.StatusOK, result)
+}
+
+// function to parse a GraphQL query, validate it against the schema and check its cost
+func parseGraphQL(req graphqlRequest) (*ast.Document, []gqlerrors.FormattedError) {
+	document, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(req.Query), Name: "GraphQL request"})})
+	if err != nil {
+		return nil, gqlerrors.FormatErrors(err)
+	}
+	if validation := graphql.ValidateDocument(&graphqlSchema, document, nil); !validation.IsValid {
+		return nil, validation.Errors
+	}
+	if err := checkQueryCost(document, req.OperationName, req.Variables); err != nil {
+		return nil, gqlerrors.FormatErrors(err)
+	}
+	return document, nil
+}
+
+// depth and complexity of a selection set
+type queryCost struct {
+	depth      int
+	complexity int
+}
+
+// function to reject queries deeper than graphqlMaxDepth or more complex than graphqlMaxComplexity
+// every field costs one and the fields selected on a receipts list are counted once per receipt it may return,
+// introspection fields are not counted
+func checkQueryCost(document *ast.Document, operationName string, variables map[string]interface{}) error {
+	fragments := map[string]*ast.FragmentDefinition{}
+	for _, definition := range document.Definitions {
+		if fragment, ok := definition.(*ast.FragmentDefinition); ok {
+			fragments[fragment.Name.Value] = fragment
+		}
+	}
+	costs := queryCostCounter{fragments: fragments, variables: variables, fragmentCosts: map[string]queryCost{}}
+	for _, definition := range document.Definitions {
+		operation, ok := definition.(*ast.OperationDefinition)
+		if !ok || (operationName != "" && (operation.Name == nil || operation.Name.Value != operationName)) {
+			continue
+		}
+		cost := costs.selectionSet(operation.SelectionSet)
+		if cost.depth > graphqlMaxDepth {
+			return fmt.Errorf("query depth %d exceeds the limit of %d", cost.depth, graphqlMaxDepth)
+		}
+		if cost.complexity > graphqlMaxComplexity {
+			return fmt.Errorf("query complexity %d exceeds the limit of %d", cost.complexity, graphqlMaxComplexity)
+		}
+	}
+	return nil
+}
+
+// measures selection sets, the cost of each fragment is measured once
+type queryCostCounter struct {
+	fragments     map[string]*ast.FragmentDefinition
+	variables     map[string]interface{}
+	fragmentCosts map[string]queryCost
+}
+
+func (c *queryCostCounter) selectionSet(set *ast.SelectionSet) queryCost {
+	var total queryCost
+	if set == nil {
+		return total
+	}
+	for _, selection := range set.Selections {
+		var cost queryCost
+		switch s := selection.(type) {
+		case *ast.Field:
+			if strings.HasPrefix(s.Name.Value, "__") {
+				continue
+			}
+			cost = c.selectionSet(s.SelectionSet)
+			cost.depth++
+			cost.complexity = 1 + cost.complexity*c.listSize(s)
+		case *ast.InlineFragment:
+			cost = c.selectionSet(s.SelectionSet)
+		case *ast.FragmentSpread:
+			cost = c.fragment(s.Name.Value)
+		}
+		total.depth = max(total.depth, cost.depth)
+		total.complexity += cost.complexity
+	}
+	return total
+}
+
+func (c *queryCostCounter) fragment(name string) queryCost {
+	if cost, ok := c.fragmentCosts[name]; ok {
+		return cost
+	}
+	fragment, ok := c.fragments[name]
+	if !ok {
+		return queryCost{}
+	}
+	cost := c.selectionSet(fragment.SelectionSet)
+	c.fragmentCosts[name] = cost
+	return cost
+}
+
+// function to return the number of receipts a receipts field may return, 1 for any other field
+func (c *queryCostCounter) listSize(field *ast.Field) int {
+	if field.Name.Value != "receipts" {
+		return 1
+	}
+	for _, argument := range field.Arguments {
+		if argument.Name.Value != "limit" {
+			continue
+		}
+		switch value := argument.Value.(type) {
+		case *ast.IntValue:
+			if limit, err := strconv.Atoi(value.Value); err == nil {
+				return max(limit, 1)
+			}
+		case *ast.Variable:
+			if limit, ok := c.variables[value.Name.Value].(float64); ok {
+				return max(int(limit), 1)
+			}
+		}
+	}
+	return graphqlDefaultLimit
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Helper function to post a GraphQL query to the router and decode the response
+func postGraphQL(t *testing.T, router http.Handler, body string) (int, map[string]interface{}, []map[string]interface{}) {
+	req := httptest.NewRequest("POST", "/graphql", strings.NewReader(body))
+	req.Header.Set("Authorization", "graphql-user")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var response struct {
+		Data   map[string]interface{}   `json:"data"`
+		Errors []map[string]interface{} `json:"errors"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Fatalf("error decoding response to %s: %v", body, err)
+	}
+	return rr.Code, response.Data, response.Errors
+}
+
+func TestGraphQL(t *testing.T) {
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"graphql-user"})
+	tenant := APIKeys["graphql-user"]
+	savedStore := store
+	store = newMemoryStore()
+	defer func() { store = savedStore }()
+	for _, receipt := range []Receipt{
+		{ID: "a", Retailer: "Target", PurchaseDate: "2022-01-01", PurchaseTime: "13:01", Total: "35.35", Points: 28, Tenant: tenant,
+			Items: []Item{{ShortDescription: "Mountain Dew 12PK", Price: "6.49"}}, Breakdown: []ruleScore{{Rule: "retailerName", Points: 6}}},
+		{ID: "b", Retailer: "Target", Points: 10, Tenant: tenant},
+		{ID: "c", Retailer: "M&M Corner Market", Points: 109, Tenant: tenant},
+		// submitted by another key, never returned or aggregated
+		{ID: "d", Retailer: "Target", Points: 500, Tenant: "key-other"},
+		{ID: "e", Retailer: "Walmart", Points: 5, Tenant: "key-other"},
+	} {
+		store.Save(receipt)
+	}
+	router := newRouter()
+
+	// receipt with its items and breakdown
+	status, data, errs := postGraphQL(t, router, `{"query":"{ receipt(id: \"a\") { retailer points calculationError items { price } breakdown { rule points } } }"}`)
+	if status != http.StatusOK || len(errs) != 0 {
+		t.Fatalf("Expected status code %d without errors, got %d %v", http.StatusOK, status, errs)
+	}
+	receipt := data["receipt"].(map[string]interface{})
+	if receipt["retailer"] != "Target" || receipt["points"] != 28.0 || receipt["calculationError"] != false ||
+		len(receipt["items"].([]interface{})) != 1 || len(receipt["breakdown"].([]interface{})) != 1 {
+		t.Errorf("Unexpected receipt %v", receipt)
+	}
+
+	// unknown receipt and another tenant's receipt
+	for _, id := range []string{"unknown", "d"} {
+		_, data, errs = postGraphQL(t, router, `{"query":"{ receipt(id: \"`+id+`\") { id } }"}`)
+		if len(errs) != 0 || data["receipt"] != nil {
+			t.Errorf("%s: expected a null receipt, got %v %v", id, data, errs)
+		}
+	}
+
+	// receipts filtered by retailer, ordered by id and paginated with variables
+	_, data, errs = postGraphQL(t, router, `{"query":"query($retailer: String, $limit: Int) { receipts(retailer: $retailer, limit: $limit, offset: 1) { id } }","variables":{"retailer":"Target","limit":5}}`)
+	receipts, _ := data["receipts"].([]interface{})
+	if len(errs) != 0 || len(receipts) != 1 || receipts[0].(map[string]interface{})["id"] != "b" {
+		t.Errorf("Expected receipt b, got %v %v", data, errs)
+	}
+
+	// per retailer aggregates, ordered by retailer
+	_, data, errs = postGraphQL(t, router, `{"query":"{ retailerStats { retailer receipts totalPoints averagePoints maxPoints } }"}`)
+	stats, _ := data["retailerStats"].([]interface{})
+	if len(errs) != 0 || len(stats) != 2 {
+		t.Fatalf("Expected stats for 2 retailers, got %v %v", data, errs)
+	}
+	target := stats[1].(map[string]interface{})
+	if target["retailer"] != "Target" || target["receipts"] != 2.0 || target["totalPoints"] != 38.0 || target["averagePoints"] != 19.0 || target["maxPoints"] != 28.0 {
+		t.Errorf("Unexpected stats %v", target)
+	}
+
+	// limit outside the accepted range is a field error
+	status, _, errs = postGraphQL(t, router, `{"query":"{ receipts(limit: 0) { id } }"}`)
+	if status != http.StatusOK || len(errs) != 1 {
+		t.Errorf("Expected status code %d with a field error, got %d %v", http.StatusOK, status, errs)
+	}
+
+	// queries that cannot be executed
+	tests := []struct {
+		name  string
+		body  string
+		error string
+	}{
+		{"syntax error", `{"query":"{ receipts { id "}`, "Syntax Error"},
+		{"unknown field", `{"query":"{ receipts { coupon } }"}`, "coupon"},
+		{"too complex", `{"query":"query($n: Int) { receipts(limit: $n) { id retailer purchaseDate purchaseTime total points calculationError items { price shortDescription } breakdown { rule points } } }","variables":{"n":100}}`, "complexity"},
+		{"too complex with fragments", `{"query":"{ a: receipts(limit: 100) { ...r } b: receipts(limit: 100) { ...r } } fragment r on Receipt { id retailer total points items { price } breakdown { rule } }"}`, "complexity"},
+	}
+	for _, test := range tests {
+		status, data, errs := postGraphQL(t, router, test.body)
+		if status != http.StatusBadRequest || data != nil {
+			t.Errorf("%s: expected status code %d without data, got %d %v", test.name, http.StatusBadRequest, status, data)
+		}
+		if len(errs) == 0 || !strings.Contains(errs[0]["message"].(string), test.error) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.error, errs)
+		}
+	}
+
+	graphqlMaxDepth = 2
+	defer func() { graphqlMaxDepth = 10 }()
+	status, _, errs = postGraphQL(t, router, `{"query":"{ receipt(id: \"a\") { items { price } } }"}`)
+	if status != http.StatusBadRequest || len(errs) != 1 || !strings.Contains(errs[0]["message"].(string), "depth") {
+		t.Errorf("Expected status code %d with a depth error, got %d %v", http.StatusBadRequest, status, errs)
+	}
+}
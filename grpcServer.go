@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"fetch_rewards/receiptpb"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// command line flags
+var grpcListenAddr = ":9090"
+
+// gRPC implementation of the receipt service, sharing validation, scoring and the store with the HTTP handlers
+type receiptService struct {
+	receiptpb.UnimplementedReceiptServiceServer
+}
+
+// function to create the gRPC server, served with TLS when a TLS config is provided
+func newGRPCServer(tlsConfig *tls.Config) *grpc.Server {
+	options := []grpc.ServerOption{
+		grpc.MaxRecvMsgSize(int(maxBodyBytes)),
+		grpc.ChainUnaryInterceptor(grpcUnaryInterceptor),
+		grpc.ChainStreamInterceptor(grpcStreamInterceptor),
+	}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(options...)
+	receiptpb.RegisterReceiptServiceServer(server, &receiptService{})
+	return server
+}
+
+// function to stop the gRPC server, in-flight calls are given the timeout to complete
+func stopGRPCServer(server *grpc.Server, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		logger.Warn("gRPC calls still in flight after the shutdown timeout, stopping")
+		server.Stop()
+	}
+}
+
+// function to describe a gRPC call as an HTTP request so the HTTP authenticators apply to it
+// metadata becomes headers and the path is the full method name, e.g. /receipts.v1.ReceiptService/GetPoints,
+// so per route auth overrides can be set for gRPC methods
+func grpcHTTPRequest(ctx context.Context, fullMethod string) *http.Request {
+	header := http.Header{}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	r := &http.Request{Method: http.MethodPost, URL: &url.URL{Path: fullMethod}, Header: header, Body: http.NoBody, Proto: "HTTP/2.0", ProtoMajor: 2}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			state := tlsInfo.State
+			r.TLS = &state
+		}
+	}
+	return r.WithContext(ctx)
+}
+
+// function to set up a gRPC call the way the HTTP middleware sets up requests:
+// request ID, request logger, server span and authentication
+// returns the call context and a function ending the span with the call error
+func startGRPCCall(ctx context.Context, fullMethod string) (context.Context, func(error), error) {
+	r := grpcHTTPRequest(ctx, fullMethod)
+	requestID := r.Header.Get(requestIDHeader)
+	if !validRequestID.MatchString(requestID) {
+		requestID = uuid.New().String()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, requestID))
+	ctx = context.WithValue(ctx, requestIDContextKey, requestID)
+	ctx = withLogger(ctx, loggerFromContext(ctx).With("requestId", requestID, "grpcMethod", fullMethod))
+
+	ctx, span := tracer.Start(ctx, fullMethod, trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("rpc.system", "grpc"), attribute.String("request.id", requestID)))
+	end := func(err error) {
+		code := status.Code(err)
+		span.SetAttributes(attribute.Int("rpc.grpc.status_code", int(code)))
+		if code == grpccodes.Internal || code == grpccodes.Unknown {
+			span.SetStatus(codes.Error, code.String())
+		}
+		span.End()
+	}
+	if span.SpanContext().IsValid() {
+		ctx = withLogger(ctx, loggerFromContext(ctx).With("traceId", span.SpanContext().TraceID().String()))
+	}
+
+	r = r.WithContext(ctx)
+	mode := authModeFor(r, parseRouteAuthModes(routeAuthModes))
+	if mode != authModeNone {
+		identity, err := authenticateRequest(r, mode)
+		// signatures cover the HTTP request body, gRPC calls have none to hash so signing would not protect the message
+		if err == nil && r.Header.Get(hmacSignatureHeader) != "" {
+			err = errors.New("signed requests are not supported over gRPC")
+		}
+		if err != nil {
+			loggerFromContext(ctx).Warn("unauthorized request", "authMode", mode, "claimedKeyId", identity, "error", err)
+			auditAuthFailure(r, identity, err.Error())
+			authFailuresTotal.WithLabelValues(mode).Inc()
+			err = status.Error(grpccodes.Unauthenticated, "valid credentials are required")
+			end(err)
+			return nil, nil, err
+		}
+		r = withIdentity(r, identity)
+	}
+
+	// every authenticated call is audited, as auditRequests does for HTTP requests
+	details := &requestAudit{}
+	r = r.WithContext(context.WithValue(r.Context(), auditContextKey, details))
+	finish := func(err error) {
+		if identityFromRequest(r) != "" {
+			entry := newAuditEntry(r)
+			entry.Status = grpcHTTPStatus(status.Code(err))
+			entry.ReceiptID = details.receiptID
+			switch {
+			case entry.Status == http.StatusUnauthorized || entry.Status == http.StatusForbidden:
+				entry.Outcome = auditOutcomeDenied
+			case entry.Status >= 400:
+				entry.Outcome = auditOutcomeFailure
+			default:
+				entry.Outcome = auditOutcomeSuccess
+			}
+			audit.record(entry)
+		}
+		end(err)
+	}
+	if err := grpcRateLimit(r); err != nil {
+		finish(err)
+		return nil, nil, err
+	}
+	return r.Context(), finish, nil
+}
+
+// actions recorded in the audit log for gRPC methods, matching the HTTP route names
+var grpcAuditActions = map[string]string{
+	receiptpb.ReceiptService_ProcessReceipt_FullMethodName:  "receipt.process",
+	receiptpb.ReceiptService_ProcessReceipts_FullMethodName: "receipt.process",
+	receiptpb.ReceiptService_GetPoints_FullMethodName:       "receipt.points",
+	receiptpb.ReceiptService_GetReceipt_FullMethodName:      "receipt.get",
+}
+
+// function to map a gRPC status code to the HTTP status recorded in the audit log
+func grpcHTTPStatus(code grpccodes.Code) int {
+	switch code {
+	case grpccodes.OK:
+		return http.StatusOK
+	case grpccodes.InvalidArgument:
+		return http.StatusBadRequest
+	case grpccodes.Unauthenticated:
+		return http.StatusUnauthorized
+	case grpccodes.PermissionDenied:
+		return http.StatusForbidden
+	case grpccodes.NotFound:
+		return http.StatusNotFound
+	case grpccodes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case grpccodes.Canceled:
+		return 499
+	}
+	return http.StatusInternalServerError
+}
+
+// function to apply the callers rate limit to a gRPC call, see rateLimitRequests
+// calls over the limit fail with ResourceExhausted and the delay before retrying
+func grpcRateLimit(r *http.Request) error {
+	caller := rateLimitCaller(r)
+	allowed, _, wait := limiter.allow(caller, limitFor(caller))
+	if allowed {
+		return nil
+	}
+	loggerFromContext(r.Context()).Warn("rate limit exceeded", "caller", caller)
+	return resourceExhausted("rate limit exceeded", wait)
+}
+
+// function to count a receipt processed over gRPC against the callers daily quota, see reserveReceiptQuota
+func reserveGRPCQuota(ctx context.Context) error {
+	caller := rateLimitCaller(grpcHTTPRequest(ctx, ""))
+	if allowed, _ := limiter.reserveQuota(caller, limitFor(caller)); allowed {
+		return nil
+	}
+	loggerFromContext(ctx).Warn("daily receipt quota exceeded", "caller", caller)
+	return resourceExhausted("daily receipt quota exceeded, quotas reset at midnight UTC", untilQuotaReset())
+}
+
+// function to create a ResourceExhausted status telling the client when to retry
+func resourceExhausted(message string, retryAfter time.Duration) error {
+	st := status.New(grpccodes.ResourceExhausted, message)
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+func grpcUnaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, end, err := startGRPCCall(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := handler(ctx, req)
+	end(err)
+	return resp, err
+}
+
+func grpcStreamInterceptor(srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, end, err := startGRPCCall(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	err = handler(srv, &contextServerStream{ServerStream: stream, ctx: ctx})
+	end(err)
+	return err
+}
+
+// server stream carrying the call context set up by the stream interceptor
+type contextServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextServerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *receiptService) ProcessReceipt(ctx context.Context, req *receiptpb.ProcessReceiptRequest) (*receiptpb.ProcessReceiptResponse, error) {
+	receipt := receiptFromProto(req)
+	if requestErr := validateReceipt(receipt); requestErr != nil {
+		publishReceiptRejected(identityFromContext(ctx), requestErr)
+		return nil, invalidArgument(requestErr)
+	}
+	if err := reserveGRPCQuota(ctx); err != nil {
+		return nil, err
+	}
+	if err := scoreAndSave(ctx, &receipt); err != nil {
+		return nil, status.Error(grpccodes.Internal, "internal error")
+	}
+	auditReceiptID(ctx, receipt.ID)
+	return &receiptpb.ProcessReceiptResponse{Id: receipt.ID, Points: int64(receipt.Points)}, nil
+}
+
+func (s *receiptService) GetPoints(ctx context.Context, req *receiptpb.GetPointsRequest) (*receiptpb.GetPointsResponse, error) {
+	receipt, err := getReceipt(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return &receiptpb.GetPointsResponse{Points: int64(receipt.Points)}, nil
+}
+
+func (s *receiptService) GetReceipt(ctx context.Context, req *receiptpb.GetReceiptRequest) (*receiptpb.Receipt, error) {
+	receipt, err := getReceipt(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return receiptToProto(receipt), nil
+}
+
+// invalid receipts are reported in their response so the rest of the stream is still processed,
+// each valid receipt counts against the daily quota and the stream ends once it is exceeded
+func (s *receiptService) ProcessReceipts(stream receiptpb.ReceiptService_ProcessReceiptsServer) error {
+	for index := uint32(0); ; index++ {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		response := &receiptpb.ProcessReceiptsResponse{Index: index}
+		receipt := receiptFromProto(req)
+		if requestErr := validateReceipt(receipt); requestErr != nil {
+			publishReceiptRejected(identityFromContext(stream.Context()), requestErr)
+			response.Result = &receiptpb.ProcessReceiptsResponse_Invalid{
+				Invalid: &receiptpb.FieldViolation{Field: requestErr.Field, Description: requestErr.Message},
+			}
+		} else if err := reserveGRPCQuota(stream.Context()); err != nil {
+			return err
+		} else if err := scoreAndSave(stream.Context(), &receipt); err != nil {
+			return status.Error(grpccodes.Internal, "internal error")
+		} else {
+			response.Result = &receiptpb.ProcessReceiptsResponse_Receipt{
+				Receipt: &receiptpb.ProcessReceiptResponse{Id: receipt.ID, Points: int64(receipt.Points)},
+			}
+		}
+		if err := stream.Send(response); err != nil {
+			return err
+		}
+	}
+}
+
+// function to look up a receipt for a gRPC call, returns a NotFound status when there is no such receipt
+func getReceipt(ctx context.Context, id string) (Receipt, error) {
+	auditReceiptID(ctx, id)
+	_, span := startStoreSpan(ctx, "get", id)
+	receipt, found := store.Get(id)
+	span.End()
+	if !found || receipt.Deleted != nil {
+		return Receipt{}, status.Error(grpccodes.NotFound, "no receipt found for id "+id)
+	}
+	return receipt, nil
+}
+
+// function to convert a validation error to an InvalidArgument status with the field at fault
+func invalidArgument(requestErr *requestError) error {
+	st := status.New(grpccodes.InvalidArgument, requestErr.Message)
+	if requestErr.Field == "" {
+		return st.Err()
+	}
+	detailed, err := st.WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{Field: requestErr.Field, Description: requestErr.FieldMessage}},
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+func receiptFromProto(req *receiptpb.ProcessReceiptRequest) Receipt {
+	receipt := Receipt{
+		Retailer:     req.GetRetailer(),
+		PurchaseDate: req.GetPurchaseDate(),
+		PurchaseTime: req.GetPurchaseTime(),
+		Total:        req.GetTotal(),
+	}
+	for _, item := range req.GetItems() {
+		receipt.Items = append(receipt.Items, Item{ShortDescription: item.GetShortDescription(), Price: item.GetPrice()})
+	}
+	return receipt
+}
+
+func receiptToProto(receipt Receipt) *receiptpb.Receipt {
+	message := &receiptpb.Receipt{
+		Id:               receipt.ID,
+		Retailer:         receipt.Retailer,
+		PurchaseDate:     receipt.PurchaseDate,
+		PurchaseTime:     receipt.PurchaseTime,
+		Total:            receipt.Total,
+		Points:           int64(receipt.Points),
+		CalculationError: receipt.CalulationErr,
+	}
+	for _, item := range receipt.Items {
+		message.Items = append(message.Items, &receiptpb.Item{ShortDescription: item.ShortDescription, Price: item.Price})
+	}
+	for _, score := range receipt.Breakdown {
+		message.Breakdown = append(message.Breakdown, &receiptpb.RuleScore{Rule: score.Rule, Points: int64(score.Points)})
+	}
+	return message
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"fetch_rewards/receiptpb"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Helper function to start the gRPC server on an in-memory listener and return a connected client
+func newTestGRPCClient(t *testing.T) receiptpb.ReceiptServiceClient {
+	listener := bufconn.Listen(1 << 20)
+	server := newGRPCServer(nil)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return receiptpb.NewReceiptServiceClient(conn)
+}
+
+// Helper function to build the Target example receipt, worth 28 points
+func newTestReceiptRequest() *receiptpb.ProcessReceiptRequest {
+	return &receiptpb.ProcessReceiptRequest{
+		Retailer:     "Target",
+		PurchaseDate: "2022-01-01",
+		PurchaseTime: "13:01",
+		Items: []*receiptpb.Item{
+			{ShortDescription: "Mountain Dew 12PK", Price: "6.49"},
+			{ShortDescription: "Emils Cheese Pizza", Price: "12.25"},
+			{ShortDescription: "Knorr Creamy Chicken", Price: "1.26"},
+			{ShortDescription: "Doritos Nacho Cheese", Price: "3.35"},
+			{ShortDescription: "   Klarbrunn 12-PK 12 FL OZ  ", Price: "12.00"},
+		},
+		Total: "35.35",
+	}
+}
+
+func TestGRPCReceiptService(t *testing.T) {
+	hashAPIKeys([]string{"grpc-user"})
+	client := newTestGRPCClient(t)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "grpc-user", requestIDHeader, "grpc-request")
+
+	var header metadata.MD
+	processed, err := client.ProcessReceipt(ctx, newTestReceiptRequest(), grpc.Header(&header))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed.Points != 28 {
+		t.Errorf("Expected %d, got %d", 28, processed.Points)
+	}
+	if requestID := header.Get(requestIDHeader); len(requestID) != 1 || requestID[0] != "grpc-request" {
+		t.Errorf("Expected request ID %q, got %v", "grpc-request", requestID)
+	}
+
+	// the receipt is shared with the HTTP API
+	if receipt, found := store.Get(processed.Id); !found || receipt.Points != 28 {
+		t.Errorf("Expected receipt %s in the store with %d points, got %+v", processed.Id, 28, receipt)
+	}
+
+	points, err := client.GetPoints(ctx, &receiptpb.GetPointsRequest{Id: processed.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if points.Points != 28 {
+		t.Errorf("Expected %d, got %d", 28, points.Points)
+	}
+
+	receipt, err := client.GetReceipt(ctx, &receiptpb.GetReceiptRequest{Id: processed.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Retailer != "Target" || len(receipt.Items) != 5 || len(receipt.Breakdown) == 0 {
+		t.Errorf("Unexpected receipt %v", receipt)
+	}
+
+	_, err = client.GetPoints(ctx, &receiptpb.GetPointsRequest{Id: "unknown"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected %s, got %v", codes.NotFound, err)
+	}
+
+	// too many items, the field at fault is in the status details
+	invalid := newTestReceiptRequest()
+	for len(invalid.Items) <= maxReceiptItems {
+		invalid.Items = append(invalid.Items, &receiptpb.Item{ShortDescription: "Gum", Price: "1.00"})
+	}
+	_, err = client.ProcessReceipt(ctx, invalid)
+	st := status.Convert(err)
+	if st.Code() != codes.InvalidArgument {
+		t.Errorf("Expected %s, got %v", codes.InvalidArgument, err)
+	}
+	var field string
+	for _, detail := range st.Details() {
+		if badRequest, ok := detail.(*errdetails.BadRequest); ok && len(badRequest.FieldViolations) == 1 {
+			field = badRequest.FieldViolations[0].Field
+		}
+	}
+	if field != "items" {
+		t.Errorf("Expected a violation for field %q, got %v", "items", st.Details())
+	}
+
+	// streamed receipts, an invalid receipt does not end the stream
+	stream, err := client.ProcessReceipts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range []*receiptpb.ProcessReceiptRequest{newTestReceiptRequest(), invalid, newTestReceiptRequest()} {
+		if err := stream.Send(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		t.Fatal(err)
+	}
+	var responses []*receiptpb.ProcessReceiptsResponse
+	for {
+		response, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses = append(responses, response)
+	}
+	if len(responses) != 3 {
+		t.Fatalf("Expected %d, got %d", 3, len(responses))
+	}
+	for i, response := range responses {
+		if response.Index != uint32(i) {
+			t.Errorf("Expected %d, got %d", i, response.Index)
+		}
+	}
+	if responses[0].GetReceipt().GetPoints() != 28 || responses[2].GetReceipt().GetPoints() != 28 {
+		t.Errorf("Expected valid receipts to score %d, got %v", 28, responses)
+	}
+	if responses[1].GetInvalid().GetField() != "items" {
+		t.Errorf("Expected a violation for field %q, got %v", "items", responses[1])
+	}
+}
+
+func TestGRPCAuthentication(t *testing.T) {
+	client := newTestGRPCClient(t)
+
+	_, err := client.GetPoints(context.Background(), &receiptpb.GetPointsRequest{Id: "unknown"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected %s, got %v", codes.Unauthenticated, err)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bad-key")
+	stream, err := client.ProcessReceipts(ctx)
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected %s, got %v", codes.Unauthenticated, err)
+	}
+
+	// failures are audited like HTTP authentication failures
+	failures := audit.query(auditQuery{Action: "receipt.process", Outcome: auditOutcomeFailure})
+	if len(failures) == 0 || failures[len(failures)-1].Route != receiptpb.ReceiptService_ProcessReceipts_FullMethodName || failures[len(failures)-1].Status != 401 {
+		t.Errorf("Expected the authentication failure to be audited, got %+v", failures)
+	}
+
+	// signatures cannot cover a gRPC message, signed calls are refused even with a valid signature
+	HMACSecrets["grpc-partner"] = "grpc-partner-secret"
+	defer delete(HMACSecrets, "grpc-partner")
+	timestamp, nonce := strconv.FormatInt(time.Now().Unix(), 10), "grpc-nonce"
+	method := receiptpb.ReceiptService_GetPoints_FullMethodName
+	ctx = metadata.AppendToOutgoingContext(context.Background(), hmacKeyIDHeader, "grpc-partner", hmacTimestampHeader, timestamp, hmacNonceHeader, nonce,
+		hmacSignatureHeader, computeHMACSignature("grpc-partner-secret", "POST", method, timestamp, nonce, nil))
+	_, err = client.GetPoints(ctx, &receiptpb.GetPointsRequest{Id: "unknown"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected %s, got %v", codes.Unauthenticated, err)
+	}
+}
+
+func TestGRPCRateLimitsAndQuotas(t *testing.T) {
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"grpc-limited"})
+	keyID := APIKeys["grpc-limited"]
+	RateLimits[keyID] = rateLimit{RequestsPerSecond: 0.001, Burst: 2, DailyQuota: 2}
+	defer delete(RateLimits, keyID)
+	client := newTestGRPCClient(t)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "grpc-limited")
+
+	// the first receipt uses one of the two receipts in the daily quota, the second in the stream the other
+	processed, err := client.ProcessReceipt(ctx, newTestReceiptRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.ProcessReceipts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		stream.Send(newTestReceiptRequest())
+	}
+	stream.CloseSend()
+	if response, err := stream.Recv(); err != nil || response.GetReceipt() == nil {
+		t.Errorf("Expected the first streamed receipt to be processed, got %v %v", response, err)
+	}
+	_, err = stream.Recv()
+	if st := status.Convert(err); st.Code() != codes.ResourceExhausted || !strings.Contains(st.Message(), "quota") {
+		t.Errorf("Expected the quota to end the stream, got %v", err)
+	}
+
+	// the burst of 2 calls is used up
+	_, err = client.GetPoints(ctx, &receiptpb.GetPointsRequest{Id: processed.Id})
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("Expected %s, got %v", codes.ResourceExhausted, err)
+	}
+	var retryDelay time.Duration
+	for _, detail := range st.Details() {
+		if retryInfo, ok := detail.(*errdetails.RetryInfo); ok {
+			retryDelay = retryInfo.RetryDelay.AsDuration()
+		}
+	}
+	if retryDelay <= 0 {
+		t.Errorf("Expected a retry delay, got %v", st.Details())
+	}
+
+	// every call is audited with the receipt it acted on
+	entries := audit.query(auditQuery{KeyID: keyID})
+	if len(entries) != 3 {
+		t.Fatalf("Expected %d, got %d", 3, len(entries))
+	}
+	for i, expected := range []struct {
+		action    string
+		status    int
+		receiptID string
+	}{
+		{"receipt.process", 200, processed.Id},
+		{"receipt.process", 429, ""},
+		{"receipt.points", 429, ""},
+	} {
+		if entries[i].Action != expected.action || entries[i].Status != expected.status || entries[i].ReceiptID != expected.receiptID {
+			t.Errorf("Expected %s %d %s, got %+v", expected.action, expected.status, expected.receiptID, entries[i])
+		}
+	}
+}
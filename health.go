@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// build information, set at build time with
+// -ldflags "-X main.buildCommit=<git commit> -X main.buildTime=<RFC 3339 time>"
+// falls back to the version control information embedded by the go toolchain
+var buildCommit = ""
+var buildTime = ""
+
+// version of the scoring rules applied by CalculatePoints
+var ruleSetVersion = "1"
+
+// function to handle liveness probes, the process is up and serving requests
+func Healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// function to handle readiness probes, checks the receipt store is reachable and the rule set is loaded
+func Readyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]string{"store": "ok", "ruleSet": "ok"}
+	status := http.StatusOK
+	if err := store.Ping(); err != nil {
+		loggerFromContext(r.Context()).Warn("readiness check failed", "check", "store", "error", err)
+		checks["store"] = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+	if len(scoringRules) == 0 {
+		checks["ruleSet"] = "not loaded"
+		status = http.StatusServiceUnavailable
+	}
+
+	response := struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}{
+		Status: "ready",
+		Checks: checks,
+	}
+	if status != http.StatusOK {
+		response.Status = "not ready"
+	}
+	writeJSON(w, r, status, response)
+}
+
+// function to report the build and rule set version
+func Version(w http.ResponseWriter, r *http.Request) {
+	commit, builtAt := buildCommit, buildTime
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" && commit == "" {
+				commit = setting.Value
+			}
+			if setting.Key == "vcs.time" && builtAt == "" {
+				builtAt = setting.Value
+			}
+		}
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if builtAt == "" {
+		builtAt = "unknown"
+	}
+
+	response := struct {
+		Commit         string `json:"commit"`
+		BuildTime      string `json:"buildTime"`
+		GoVersion      string `json:"goVersion"`
+		RuleSetVersion string `json:"ruleSetVersion"`
+	}{
+		Commit:         commit,
+		BuildTime:      builtAt,
+		GoVersion:      runtime.Version(),
+		RuleSetVersion: ruleSetVersion,
+	}
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// function to write a JSON response body with the given status
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(response)
+	if err != nil {
+		loggerFromContext(r.Context()).Error("error encoding response", "error", err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// store that is never able to serve requests
+type unavailableStore struct {
+	*memoryStore
+}
+
+func (unavailableStore) Ping() error {
+	return errors.New("store unavailable")
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	limiter = newRateLimiter()
+	router := newRouter()
+
+	// probes and version are public
+	for _, path := range []string{"/healthz", "/readyz", "/version"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: expected status code %d, got %d", path, http.StatusOK, rr.Code)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/version", nil))
+	var version map[string]string
+	if err := json.NewDecoder(rr.Body).Decode(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version["ruleSetVersion"] != ruleSetVersion || version["commit"] == "" || version["goVersion"] == "" {
+		t.Errorf("Expected build and rule set version, got %v", version)
+	}
+
+	// readiness fails when the store is unavailable
+	savedStore := store
+	store = unavailableStore{newMemoryStore()}
+	defer func() { store = savedStore }()
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/readyz", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d, got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// command line flags
+var logMaxSizeMB = 100
+var logMaxAgeDays = 0
+var logMaxBackups = 0
+var logCompress = false
+var logRotateInterval time.Duration
+
+// function to create the log file writer, rotated once it reaches the maximum size
+// rotated files are renamed with a timestamp, optionally gzip compressed, and removed
+// once older than the maximum age or beyond the maximum count (0 keeps them)
+func newLogFileWriter(fileName string) (*lumberjack.Logger, error) {
+	writer := &lumberjack.Logger{
+		Filename:   fileName,
+		MaxSize:    logMaxSizeMB,
+		MaxAge:     logMaxAgeDays,
+		MaxBackups: logMaxBackups,
+		Compress:   logCompress,
+	}
+	// the file is opened on the first write, an empty write surfaces any error opening it now
+	if _, err := writer.Write(nil); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// function to rotate the log file on an interval and reopen it on SIGHUP
+// intervals are aligned to the clock, e.g. 24h rotates at midnight UTC
+// reopening lets external tools such as logrotate move the file away
+// log is the logger writing to the file, returns a function stopping both once any reopen or rotation in progress is done
+func manageLogFile(writer *lumberjack.Logger, interval time.Duration, log *slog.Logger) func() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	done := make(chan struct{})
+	var stopped sync.WaitGroup
+
+	var rotateTimer *time.Timer
+	var rotate <-chan time.Time
+	if interval > 0 {
+		rotateTimer = time.NewTimer(untilNextRotation(time.Now(), interval))
+		rotate = rotateTimer.C
+	}
+
+	stopped.Add(1)
+	go func() {
+		defer stopped.Done()
+		for {
+			select {
+			case <-hangup:
+				// the file is opened again by the next write, at the configured path
+				if err := writer.Close(); err != nil {
+					log.Error("failed to close log file", "error", err)
+				}
+				log.Info("reopened log file", "logFile", writer.Filename)
+			case <-rotate:
+				if err := writer.Rotate(); err != nil {
+					log.Error("failed to rotate log file", "error", err)
+				}
+				rotateTimer.Reset(untilNextRotation(time.Now(), interval))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(hangup)
+		if rotateTimer != nil {
+			rotateTimer.Stop()
+		}
+		close(done)
+		stopped.Wait()
+	}
+}
+
+// function to find the time until the next rotation boundary
+func untilNextRotation(now time.Time, interval time.Duration) time.Duration {
+	return now.Truncate(interval).Add(interval).Sub(now)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// function to wait for a condition, polling until the timeout
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+// function to test the log file is rotated by size and compressed, keeping the max count
+func TestLogRotationBySize(t *testing.T) {
+	savedSize, savedBackups, savedCompress := logMaxSizeMB, logMaxBackups, logCompress
+	logMaxSizeMB, logMaxBackups, logCompress = 1, 2, true
+	defer func() { logMaxSizeMB, logMaxBackups, logCompress = savedSize, savedBackups, savedCompress }()
+
+	dir := t.TempDir()
+	writer, err := newLogFileWriter(filepath.Join(dir, "api.log"))
+	if err != nil {
+		t.Fatalf("Error opening log file: %v", err)
+	}
+	defer writer.Close()
+
+	line := []byte(strings.Repeat("x", 1023) + "\n")
+	for i := 0; i < 4*1024; i++ {
+		writer.Write(line)
+	}
+	// compression and cleanup of rotated files happen in the background,
+	// done once every rotated file is compressed and the oldest removed
+	compressed := func() []string {
+		matches, _ := filepath.Glob(filepath.Join(dir, "api-*.log.gz"))
+		return matches
+	}
+	uncompressed := func() []string {
+		matches, _ := filepath.Glob(filepath.Join(dir, "api-*.log"))
+		return matches
+	}
+	if !waitFor(2*time.Second, func() bool { return len(compressed()) == 2 && len(uncompressed()) == 0 }) {
+		t.Errorf("Expected %d, got %d", 2, len(compressed()))
+	}
+}
+
+// function to test the log file is reopened on SIGHUP and rotated on an interval
+func TestLogFileReopenAndInterval(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "api.log")
+	writer, err := newLogFileWriter(fileName)
+	if err != nil {
+		t.Fatalf("Error opening log file: %v", err)
+	}
+	defer writer.Close()
+	stop := manageLogFile(writer, 0, logger)
+
+	writer.Write([]byte("before\n"))
+	// an external tool moves the file away and signals the server
+	os.Rename(fileName, fileName+".1")
+	syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+	reopened := waitFor(2*time.Second, func() bool {
+		writer.Write([]byte("after\n"))
+		_, err := os.Stat(fileName)
+		return err == nil
+	})
+	if !reopened {
+		t.Error("Expected the log file to be reopened at its path")
+	}
+	stop()
+
+	stop = manageLogFile(writer, 50*time.Millisecond, logger)
+	defer stop()
+	rotated := func() []string {
+		matches, _ := filepath.Glob(filepath.Join(dir, "api-*.log"))
+		return matches
+	}
+	if !waitFor(2*time.Second, func() bool { return len(rotated()) > 0 }) {
+		t.Error("Expected the log file to be rotated on the interval")
+	}
+}
+
+func TestUntilNextRotation(t *testing.T) {
+	now := time.Date(2024, 3, 1, 22, 30, 0, 0, time.UTC)
+	expected := 90 * time.Minute
+	if result := untilNextRotation(now, 24*time.Hour); result != expected {
+		t.Errorf("Expected %v, got %v", expected, result)
+	}
+}
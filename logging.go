@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// application logger, structured JSON lines with levels
+var logger *slog.Logger
+
+// level of the application logger, debug mode lowers it to slog.LevelDebug
+var logLevel = new(slog.LevelVar)
+
+const requestIDHeader = "X-Request-ID"
+
+const (
+	loggerContextKey    contextKey = "logger"
+	requestIDContextKey contextKey = "requestId"
+)
+
+// incoming request IDs are only propagated when they are reasonably sized and printable
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+func init() {
+	logger = newLogger(os.Stderr)
+}
+
+// function to create the application logger writing JSON lines to w
+func newLogger(w io.Writer) *slog.Logger {
+	return slog.New(&levelHandler{level: logLevel, handler: slog.NewJSONHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug})})
+}
+
+// handler filtering records below its level before passing them to the wrapped handler
+// lets a request logger use a different level while keeping the attributes already added
+type levelHandler struct {
+	level   slog.Leveler
+	handler slog.Handler
+}
+
+func (h *levelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *levelHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler.Handle(ctx, record)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithAttrs(attrs)}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{level: h.level, handler: h.handler.WithGroup(name)}
+}
+
+// function to copy a logger with a different minimum level
+func withLogLevel(l *slog.Logger, level slog.Level) *slog.Logger {
+	if h, ok := l.Handler().(*levelHandler); ok {
+		return slog.New(&levelHandler{level: level, handler: h.handler})
+	}
+	return l
+}
+
+// function to look up the request scoped logger, falls back to the application logger
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerContextKey).(*slog.Logger); ok {
+		return l
+	}
+	return logger
+}
+
+// function to attach a logger to the request context
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey, l)
+}
+
+// function to look up the request ID of a request
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey).(string)
+	return requestID
+}
+
+// function to assign every request an ID, propagating the callers X-Request-ID when provided
+// the ID is returned in the response header and included in every log line for the request
+func requestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = uuid.New().String()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		ctx := context.WithValue(r.Context(), requestIDContextKey, requestID)
+		ctx = withLogger(ctx, loggerFromContext(ctx).With("requestId", requestID))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
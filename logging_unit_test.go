@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestIDs(t *testing.T) {
+	var logged bytes.Buffer
+	savedLogger := logger
+	logger = newLogger(&logged)
+	defer func() { logger = savedLogger }()
+
+	handler := requestIDs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = withIdentity(r, "key-test")
+		loggerFromContext(r.Context()).Info("handled")
+	}))
+
+	// caller provided request ID is propagated to the response and log lines
+	req := httptest.NewRequest("GET", "/receipts/abc/points", nil)
+	req.Header.Set(requestIDHeader, "caller-id-123")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Header().Get(requestIDHeader) != "caller-id-123" {
+		t.Errorf("Expected request ID %q, got %q", "caller-id-123", rr.Header().Get(requestIDHeader))
+	}
+	var line map[string]interface{}
+	if err := json.Unmarshal(logged.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["requestId"] != "caller-id-123" || line["keyId"] != "key-test" || line["msg"] != "handled" {
+		t.Errorf("Expected log line with request and key IDs, got %v", line)
+	}
+
+	// invalid request IDs are replaced with a generated one
+	req = httptest.NewRequest("GET", "/receipts/abc/points", nil)
+	req.Header.Set(requestIDHeader, "bad id\nwith newline")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	generated := rr.Header().Get(requestIDHeader)
+	if generated == "" || generated == "bad id\nwith newline" {
+		t.Errorf("Expected a generated request ID, got %q", generated)
+	}
+}
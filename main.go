@@ -1,25 +1,39 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
-	"log"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Receipt struct {
-	ID            string `json:"id"`
-	Retailer      string `json:"retailer"`
-	PurchaseDate  string `json:"purchaseDate"`
-	PurchaseTime  string `json:"purchaseTime"`
-	Items         []Item `json:"items"`
-	Total         string `json:"total"`
-	Points        int    `json:"points"`
-	CalulationErr bool   `json:"calulationErr"` //	Flag to indicate if there was an error in the calculation of the points
+	ID            string            `json:"id"`
+	Retailer      string            `json:"retailer"`
+	PurchaseDate  string            `json:"purchaseDate"`
+	PurchaseTime  string            `json:"purchaseTime"`
+	Items         []Item            `json:"items"`
+	Total         string            `json:"total"`
+	Points        int               `json:"points"`
+	CalulationErr bool              `json:"calulationErr"`       //	Flag to indicate if there was an error in the calculation of the points
+	Breakdown     []ruleScore       `json:"breakdown,omitempty"` // points awarded by each scoring rule
+	Deleted       *receiptDeletion  `json:"deleted,omitempty"`   // set when the receipt has been soft deleted
+	Revisions     []receiptRevision `json:"revisions,omitempty"` // earlier revisions of a corrected receipt, oldest first
+	UpdatedAt     time.Time         `json:"updatedAt"`           // when the receipt was processed or last corrected
+	Tenant        string            `json:"tenant,omitempty"`    // key ID that submitted the receipt, receives its webhook events
+
+	log *slog.Logger // request scoped logger used while calculating points
 }
 
 type Item struct {
@@ -27,74 +41,231 @@ type Item struct {
 	Price            string `json:"price"`
 }
 
-var PointsMap = make(map[string]int)
-
 // command line flags
 var debugMode bool
 var noAuthMode bool
 var logFileName string
 var logToFile bool
+var tlsCertFile string
+var tlsKeyFile string
+var tlsClientCAFile string
 
-var logger *log.Logger
+func main() {
 
-func init() {
-	logger = log.Default()
-	logger.SetFlags(log.LstdFlags | log.Lshortfile)
-}
+	// "config print" writes the effective configuration, with secrets redacted, and exits
+	registerFlags(flag.CommandLine)
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "print" {
+		if err := loadConfig(flag.CommandLine, os.Args[3:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if err := printConfig(os.Stdout, flag.CommandLine); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 
-func main() {
+	// exit once run has returned and every deferred flush has run
+	if err := run(); err != nil {
+		os.Exit(1)
+	}
+}
 
-	// handle command line flags
-	flag.BoolVar(&debugMode, "debug", false, "Run in debug mode")
-	flag.BoolVar(&noAuthMode, "noauth", false, "Run in test mode")
-	flag.BoolVar(&logToFile, "log", false, "Enable logging to a file")
-	flag.StringVar(&logFileName, "logfile", "logs/logfileAPI.log", "Override log file name")
-	flag.Parse()
+// function to start the servers and serve requests until SIGINT or SIGTERM
+// failures are logged and returned so deferred flushes of the store, audit log and log file still run
+func run() (err error) {
+	// handle command line flags, merged with the config file and environment
+	if err := loadConfig(flag.CommandLine, os.Args[1:]); err != nil {
+		logger.Error("invalid configuration", "error", err)
+		return err
+	}
 
 	if debugMode {
-		logger.Println("Running in debug mode, will log debug information")
+		logLevel.Set(slog.LevelDebug)
+	}
+	if logToFile {
+		logFile, err := newLogFileWriter(logFileName)
+		if err != nil {
+			logger.Error("failed to open log file", "logFile", logFileName, "error", err)
+		} else {
+			defer logFile.Close()
+			logger.Info("logging to file", "logFile", logFileName)
+			logger = newLogger(logFile)
+			// started once the logger is swapped, the file is only closed after it has stopped
+			defer manageLogFile(logFile, logRotateInterval, logger)()
+		}
+	}
+	// logged after the deferred flushes below, before the log file is closed
+	defer func() {
+		if err != nil {
+			logger.Error("server stopped", "error", err)
+		}
+	}()
+	if debugMode {
+		logger.Debug("running in debug mode, will log debug information")
 	}
 	if noAuthMode {
-		logger.Println("Running in noAuth mode API Keys will not be validated")
+		logger.Warn("-noauth is deprecated, use -authmode none")
+		authMode = authModeNone
+	}
+	if err := validateAuthConfig(); err != nil {
+		return fmt.Errorf("invalid auth configuration: %w", err)
+	}
+	if err := defaultRateLimit.validate(); err != nil {
+		return fmt.Errorf("invalid rate limit configuration: %w", err)
+	}
+	if authMode == authModeNone {
+		logger.Warn("running in auth mode none, requests will not be authenticated unless a route override applies")
 	} else {
-		// simplified generation of API keys in memory for simplicity of code review
-		hashAPIKeys([]string{"key1", "key2", "key3"})
+		logger.Info("running with authentication", "authMode", authMode)
 	}
-	if logToFile {
-		logFile, err := os.OpenFile(logFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if rulesFileName != "" {
+		rules, version, err := loadRulesFile(rulesFileName)
 		if err != nil {
-			logger.Println("Failed to open log file: ", err)
+			return fmt.Errorf("failed to load rules file %s: %w", rulesFileName, err)
 		}
-		defer logFile.Close()
-		logger.Println("Logging to file: ", logFileName)
-		logger.SetOutput(logFile)
+		scoringRules, ruleSetVersion = rules, version
+		logger.Info("loaded scoring rules", "rulesFile", rulesFileName, "ruleSetVersion", version, "rules", len(rules))
+	}
+	openedStore, err := openStore(storeBackend, storeFileName)
+	if err != nil {
+		return fmt.Errorf("failed to open %s receipt store: %w", storeBackend, err)
 	}
-	// create a new router and define routes
+	store = openedStore
+	logger.Info("opened receipt store", "store", storeBackend)
+	// credentials are always created so per route overrides can require them
+	// simplified generation of API keys in memory for simplicity of code review
+	hashAPIKeys([]string{"key1", "key2", "key3"})
+	registerAdminKeys(adminKeys)
+	// simplified client certificate subject to identity mapping for mTLS
+	ClientCertIdentities["partner1"] = "partner1"
+	if auditLogFileName != "" {
+		err := audit.openFile(auditLogFileName)
+		if err != nil {
+			logger.Error("failed to open audit log file", "auditLog", auditLogFileName, "error", err)
+		}
+	}
+	if accessLogOutput != "" {
+		openedAccessLog, err := openAccessLog(accessLogOutput, accessLogFormat)
+		if err != nil {
+			return fmt.Errorf("failed to open access log %s: %w", accessLogOutput, err)
+		}
+		accessLog = openedAccessLog
+		defer accessLog.close()
+	}
+	if traceOutput != "" {
+		shutdownTracing, err := setupTracing(traceOutput)
+		if err != nil {
+			logger.Error("failed to set up tracing", "traceOutput", traceOutput, "error", err)
+		} else {
+			defer shutdownTracing(context.Background())
+			logger.Info("exporting tracing spans", "traceOutput", traceOutput)
+		}
+	}
+	defer func() {
+		if err := audit.close(); err != nil {
+			logger.Error("error closing audit log", "error", err)
+		}
+	}()
+	defer func() {
+		if err := store.Close(); err != nil {
+			logger.Error("error flushing receipt store", "error", err)
+		}
+	}()
+	// deliveries in flight once the servers have drained are completed, queued and pending retries are dropped
+	defer webhooks.stop()
+
+	// registered before anything is served so an early signal cannot kill the process without draining
+	ctx, stop := shutdownSignalContext()
+	defer stop()
+
+	var tlsConfig *tls.Config
+	if tlsCertFile != "" {
+		tlsConfig, err = newTLSConfig(tlsCertFile, tlsKeyFile, tlsClientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to configure TLS: %w", err)
+		}
+	}
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", listenAddr, err)
+	}
+	if grpcListenAddr != "" {
+		grpcListener, err := net.Listen("tcp", grpcListenAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %w", grpcListenAddr, err)
+		}
+		grpcServer := newGRPCServer(tlsConfig)
+		go func() {
+			if err := grpcServer.Serve(grpcListener); err != nil {
+				logger.Error("gRPC server stopped", "error", err)
+			}
+		}()
+		// deferred so in-flight HTTP requests are drained first
+		defer stopGRPCServer(grpcServer, shutdownTimeout)
+		logger.Info("gRPC server is ready to handle requests", "addr", grpcListener.Addr().String(), "tls", tlsConfig != nil)
+	}
+	logger.Info("server is ready to handle requests", "addr", listener.Addr().String(), "tls", tlsConfig != nil)
+	if err := runServer(ctx, listener, newRouter(), tlsConfig); err != nil {
+		return err
+	}
+	logger.Info("server stopped")
+	return nil
+}
+
+// function to create a new router and define routes
+func newRouter() *mux.Router {
 	r := mux.NewRouter()
-	if !noAuthMode {
-		r.Use(validateAPIKey)
-	}
-	r.HandleFunc("/receipts/process", ProcessReceipts).Methods("POST")
-	r.HandleFunc("/receipts/{id}/points", GetPoints).Methods("GET")
-	r.NotFoundHandler = http.HandlerFunc(BadRoute)
-	logger.Println("Server is ready to handle requests.")
-	logger.Fatal(http.ListenAndServe(":8080", r))
+	r.Use(requestIDs)
+	r.Use(accessLogRequests)
+	r.Use(recoverPanics)
+	r.Use(traceRequests)
+	r.Use(instrumentRequests)
+	r.Use(limitRequestBodies)
+	r.Use(authenticate)
+	r.Use(requestLogLevels)
+	r.Use(auditRequests)
+	r.Use(rateLimitRequests)
+	// versioned receipt API, the unprefixed routes are deprecated aliases for v1
+	handleReceiptRoutesV1(r.PathPrefix("/v1").Subrouter())
+	handleReceiptRoutesV2(r.PathPrefix("/v2").Subrouter())
+	legacy := r.NewRoute().Subrouter()
+	legacy.Use(deprecateLegacyRoutes)
+	handleReceiptRoutesV1(legacy)
+	r.Handle("/metrics", metricsHandler).Methods("GET").Name("metrics")
+	r.HandleFunc("/healthz", Healthz).Methods("GET").Name("healthz")
+	r.HandleFunc("/readyz", Readyz).Methods("GET").Name("readyz")
+	r.HandleFunc("/version", Version).Methods("GET").Name("version")
+	r.HandleFunc("/openapi.json", OpenAPISpec).Methods("GET").Name("openapi")
+	r.HandleFunc("/docs", Docs).Methods("GET").Name("docs")
+	r.HandleFunc("/docs/{asset}", DocsAsset).Methods("GET").Name("docs.asset")
+	r.HandleFunc("/graphql", GraphQL).Methods("POST").Name("graphql")
+	r.HandleFunc("/events", StreamEvents).Methods("GET").Name("events")
+
+	admin := r.PathPrefix("/admin").Subrouter()
+	admin.Use(requireAdmin)
+	admin.HandleFunc("/audit", GetAuditLog).Methods("GET").Name("admin.audit")
+	admin.HandleFunc("/loglevel", GetLogLevel).Methods("GET").Name("admin.loglevel")
+	admin.HandleFunc("/loglevel", SetLogLevel).Methods("PUT").Name("admin.loglevel.set")
+	admin.HandleFunc("/webhooks", ListWebhooks).Methods("GET").Name("admin.webhooks")
+	admin.HandleFunc("/webhooks", CreateWebhook).Methods("POST").Name("admin.webhooks.create")
+	admin.HandleFunc("/webhooks/deadletters", GetWebhookDeadLetters).Methods("GET").Name("admin.webhooks.deadletters")
+	admin.HandleFunc("/webhooks/{id}", DeleteWebhook).Methods("DELETE").Name("admin.webhooks.delete")
+	handlePprof(admin)
+
+	r.NotFoundHandler = requestIDs(accessLogRequests(instrumentRequests(http.HandlerFunc(BadRoute))))
+	r.MethodNotAllowedHandler = requestIDs(accessLogRequests(instrumentRequests(methodNotAllowed(r))))
+	return r
 }
 
 // function to process a reciept generation request
 func ProcessReceipts(w http.ResponseWriter, r *http.Request) {
-	var receipt Receipt
-	err := json.NewDecoder(r.Body).Decode(&receipt)
-	if err != nil {
-		logger.Println("Error decoding request body: ", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	receipt, ok := processReceipt(w, r)
+	if !ok {
 		return
 	}
 
-	receipt.ID = uuid.New().String()
-	receipt.Points = CalculatePoints(receipt)
-	PointsMap[receipt.ID] = receipt.Points
-
 	response := struct {
 		ID string `json:"id"`
 	}{
@@ -102,57 +273,145 @@ func ProcessReceipts(w http.ResponseWriter, r *http.Request) {
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(response)
+	err := json.NewEncoder(w).Encode(response)
 	if err != nil {
-		logger.Println("(Process Receipts) Error encoding response", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		loggerFromContext(r.Context()).Error("error encoding response", "receiptId", receipt.ID, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "")
 		return
 	}
 }
 
+// function to decode, score and save the receipt in the request body
+// writes the error response and returns false when the receipt could not be processed
+func processReceipt(w http.ResponseWriter, r *http.Request) (Receipt, bool) {
+	_, span := tracer.Start(r.Context(), "decode receipt")
+	receipt, err := decodeReceipt(r)
+	span.End()
+	if err != nil {
+		// bodies too large to read are not receipts
+		if err.Status == http.StatusBadRequest {
+			publishReceiptRejected(identityFromRequest(r), err)
+		}
+		writeRequestError(w, r, err)
+		return Receipt{}, false
+	}
+	if !reserveReceiptQuota(w, r) {
+		return Receipt{}, false
+	}
+
+	if err := scoreAndSave(r.Context(), &receipt); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "")
+		return Receipt{}, false
+	}
+	auditReceiptID(r.Context(), receipt.ID)
+	return receipt, true
+}
+
+// function to assign a new receipt an ID, calculate its points and save it, shared by the HTTP and gRPC APIs
+func scoreAndSave(ctx context.Context, receipt *Receipt) error {
+	receipt.ID = uuid.New().String()
+	receipt.Tenant = identityFromContext(ctx)
+	receipt.Points = CalculatePoints(ctx, receipt)
+	receipt.UpdatedAt = time.Now().UTC()
+	_, span := startStoreSpan(ctx, "save", receipt.ID)
+	err := store.Save(*receipt)
+	span.End()
+	if err != nil {
+		loggerFromContext(ctx).Error("error saving receipt", "receiptId", receipt.ID, "error", err)
+		return err
+	}
+	receiptsProcessedTotal.Inc()
+	receiptPoints.Observe(float64(receipt.Points))
+	publishReceiptEvents(*receipt, nil)
+	return nil
+}
+
 // function to look up points for a given receipt
 func GetPoints(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	recieptID := vars["id"]
-	points, recieptFound := PointsMap[recieptID]
-	if !recieptFound {
-		http.Error(w, "recipet not found", http.StatusNotFound)
+	receipt, found := findReceipt(w, r)
+	if !found || receiptNotModified(w, r, receipt) {
 		return
 	}
 
 	response := struct {
 		Points int `json:"points"`
 	}{
-		Points: points,
+		Points: receipt.Points,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	err := json.NewEncoder(w).Encode(response)
 	if err != nil {
-		logger.Println("(Get Points) Error encoding response", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		loggerFromContext(r.Context()).Error("error encoding response", "receiptId", receipt.ID, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "")
 		return
 	}
 }
 
+// function to look up the receipt with the ID in the request path
+// writes a not found response and returns false when there is no such receipt
+func findReceipt(w http.ResponseWriter, r *http.Request) (Receipt, bool) {
+	vars := mux.Vars(r)
+	recieptID := vars["id"]
+	_, span := startStoreSpan(r.Context(), "get", recieptID)
+	receipt, recieptFound := store.Get(recieptID)
+	span.End()
+	if !recieptFound || receipt.Deleted != nil {
+		writeError(w, r, http.StatusNotFound, "no receipt found for id "+recieptID)
+		return Receipt{}, false
+	}
+	return receipt, true
+}
+
+// function to look up a receipt the caller can read, receipts of other tenants are answered 404 like missing ones
+func findTenantReceipt(w http.ResponseWriter, r *http.Request) (Receipt, bool) {
+	receipt, found := findReceipt(w, r)
+	if found && !receiptVisibleTo(r.Context(), receipt) {
+		writeError(w, r, http.StatusNotFound, "no receipt found for id "+receipt.ID)
+		return Receipt{}, false
+	}
+	return receipt, found
+}
+
+// function to check whether the caller can read a receipt, keys only see the receipts they submitted
+// admins and unauthenticated callers (auth mode none) see every tenant, as on the event stream
+func receiptVisibleTo(ctx context.Context, receipt Receipt) bool {
+	identity := identityFromContext(ctx)
+	return identity == "" || AdminKeyIDs[identity] || receipt.Tenant == identity
+}
+
 // function to handle routing errors
-func BadRoute(w http.ResponseWriter, _ *http.Request) {
-	http.Error(w, "404 not found", http.StatusNotFound)
+func BadRoute(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, "no route matches "+r.URL.Path)
 }
 
 // function to calculate points for given receipt
 // Allows for calulation to continue even if there are issues with reciept data,
 // receipts is marked as having a calculation error, but the total points are still calculated
-func CalculatePoints(receipt Receipt) int {
+func CalculatePoints(ctx context.Context, receipt *Receipt) int {
 	points := 0
+	receipt.Breakdown = make([]ruleScore, 0, len(scoringRules))
+	receipt.log = loggerFromContext(ctx).With("receiptId", receipt.ID)
+	defer func() { receipt.log = nil }()
+	ctx, span := tracer.Start(ctx, "calculate points", trace.WithAttributes(attribute.String("receipt.id", receipt.ID)))
+	defer span.End()
 
-	points += retailerNamePoints(receipt.Retailer)
-	points += receiptTotalPoints(&receipt)
-	points += itemPoints(&receipt)
-	points += dateAndTimePoints(&receipt)
-
-	if debugMode {
-		logger.Println("CalculatePoints: ", points)
+	for _, rule := range scoringRules {
+		_, ruleSpan := tracer.Start(ctx, "rule "+rule.Name)
+		hadErr := receipt.CalulationErr
+		rulePoints := rule.Points(receipt)
+		if receipt.CalulationErr && !hadErr {
+			calculationErrorsTotal.WithLabelValues(rule.Name).Inc()
+			ruleSpan.SetAttributes(attribute.Bool("receipt.calculation_error", true))
+		}
+		ruleSpan.SetAttributes(attribute.Int("rule.points", rulePoints))
+		ruleSpan.End()
+		receipt.log.Debug("scoring rule applied", "rule", rule.Name, "points", rulePoints)
+		points += rulePoints
+		receipt.Breakdown = append(receipt.Breakdown, ruleScore{Rule: rule.Name, Points: rulePoints})
 	}
+	span.SetAttributes(attribute.Int("receipt.points", points))
+
+	receipt.log.Debug("points calculated", "points", points, "calculationErr", receipt.CalulationErr)
 	return points
 }
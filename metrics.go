@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// registry exposed at /metrics, separate from the global registry so only our metrics are served
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests handled, by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency, by route, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	receiptsProcessedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "receipts_processed_total",
+		Help: "Receipts processed and scored.",
+	})
+
+	receiptPoints = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "receipt_points",
+		Help:    "Points awarded per processed receipt.",
+		Buckets: []float64{0, 10, 25, 50, 75, 100, 150, 200, 300, 500},
+	})
+
+	receiptsCorrectedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "receipts_corrected_total",
+		Help: "Receipts corrected and scored again.",
+	})
+
+	receiptsDeletedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "receipts_deleted_total",
+		Help: "Receipts soft deleted.",
+	})
+
+	calculationErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "receipt_calculation_errors_total",
+		Help: "Receipts flagged with a calculation error, by scoring rule.",
+	}, []string{"rule"})
+
+	webhookDeliveriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "webhook_deliveries_total",
+		Help: "Webhook delivery attempts, by outcome (delivered, retried or dead_lettered).",
+	}, []string{"outcome"})
+
+	eventStreamsOpen = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "event_streams_open",
+		Help: "Server-Sent Events streams currently open.",
+	})
+
+	authFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "auth_failures_total",
+		Help: "Requests rejected by authentication, by auth mode.",
+	}, []string{"mode"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		httpRequestsTotal,
+		httpRequestDuration,
+		receiptsProcessedTotal,
+		receiptPoints,
+		receiptsCorrectedTotal,
+		receiptsDeletedTotal,
+		calculationErrorsTotal,
+		webhookDeliveriesTotal,
+		eventStreamsOpen,
+		authFailuresTotal,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "receipts_stored",
+			Help: "Receipts currently held in the receipt store.",
+		}, func() float64 { return float64(store.Len()) }),
+	)
+}
+
+// handler serving the metrics in the Prometheus text format
+var metricsHandler = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+// function to record request counts and latency per route, the route is the path template
+// so receipt IDs do not create a new series per receipt
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		// requests that matched no route share one label so arbitrary paths cannot grow the series
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		status := strconv.Itoa(recorder.status)
+		httpRequestsTotal.WithLabelValues(route, r.Method, status).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"metrics-key"})
+	router := newRouter()
+
+	// receipt with an unparsable total, an auth failure and a missing receipt
+	sendRequest(router, "POST", "/receipts/process", "metrics-key", `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[],"total":"abc"}`, nil)
+	sendRequest(router, "POST", "/receipts/process", "bad-key", `{}`, nil)
+	sendRequest(router, "GET", "/receipts/missing/points", "metrics-key", "", nil)
+	// no matching route, wrong method
+	sendRequest(router, "GET", "/no/such/route", "metrics-key", "", nil)
+	sendRequest(router, "DELETE", "/healthz", "metrics-key", "", nil)
+
+	// metrics are public by default
+	rr := sendRequest(router, "GET", "/metrics", "", "", nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	body, _ := io.ReadAll(rr.Body)
+	for _, expected := range []string{
+		`http_requests_total{method="POST",route="/receipts/process",status="200"}`,
+		`http_requests_total{method="POST",route="/receipts/process",status="401"}`,
+		`http_requests_total{method="GET",route="/receipts/{id}/points",status="404"}`,
+		`http_requests_total{method="GET",route="unknown",status="404"}`,
+		`http_requests_total{method="DELETE",route="unknown",status="405"}`,
+		`http_request_duration_seconds_bucket{method="POST",route="/receipts/process",status="200",le="+Inf"}`,
+		`receipts_processed_total`,
+		`receipt_points_count`,
+		`receipt_calculation_errors_total{rule="receiptTotal"}`,
+		`auth_failures_total{mode="chained"}`,
+		`receipts_stored`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected metrics to contain %s", expected)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	_ "embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	swaggerFiles "github.com/swaggo/files/v2"
+)
+
+// OpenAPI 3 description of every route, kept in sync with newRouter by the unit tests
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// interactive documentation for the OpenAPI document, Swagger UI is served from the binary so the page
+// works offline and runs no third party script
+const docsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Receipt Processor API</title>
+  <link rel="stylesheet" href="/docs/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="/docs/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+// function to serve the OpenAPI document
+func OpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// function to serve the interactive API documentation
+func Docs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(docsPage))
+}
+
+// Swagger UI assets used by the documentation page and their content types, the version is pinned in go.mod
+var docsAssets = map[string]string{
+	"swagger-ui.css":       "text/css; charset=utf-8",
+	"swagger-ui-bundle.js": "text/javascript; charset=utf-8",
+}
+
+// function to serve a Swagger UI asset embedded in the binary
+func DocsAsset(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["asset"]
+	contentType, found := docsAssets[name]
+	if !found {
+		BadRoute(w, r)
+		return
+	}
+	data, err := fs.ReadFile(swaggerFiles.FS, name)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "documentation asset is unavailable")
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(data)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// function to test every route registered on the router is described in the OpenAPI document and vice versa
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatalf("Error decoding OpenAPI document: %v", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("Expected an OpenAPI 3 document, got %q", spec.OpenAPI)
+	}
+	documented := map[string]bool{}
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			if method != "parameters" && method != "summary" && method != "description" {
+				documented[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+
+	registered := map[string]bool{}
+	err := newRouter().Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// subrouters have no methods of their own
+			return nil
+		}
+		for _, method := range methods {
+			registered[method+" "+template] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for operation := range registered {
+		if !documented[operation] {
+			t.Errorf("Route %s is missing from the OpenAPI document", operation)
+		}
+	}
+	for operation := range documented {
+		if !registered[operation] {
+			t.Errorf("OpenAPI operation %s has no route", operation)
+		}
+	}
+}
+
+func TestOpenAPIEndpoints(t *testing.T) {
+	limiter = newRateLimiter()
+	router := newRouter()
+	for path, contentType := range map[string]string{
+		"/openapi.json":              "application/json",
+		"/docs":                      "text/html; charset=utf-8",
+		"/docs/swagger-ui.css":       "text/css; charset=utf-8",
+		"/docs/swagger-ui-bundle.js": "text/javascript; charset=utf-8",
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: expected status code %d, got %d", path, http.StatusOK, rr.Code)
+		}
+		if rr.Header().Get("Content-Type") != contentType {
+			t.Errorf("%s: expected content type %s, got %s", path, contentType, rr.Header().Get("Content-Type"))
+		}
+	}
+
+	// only the assets used by the page are served
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/docs/index.html", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, rr.Code)
+	}
+}
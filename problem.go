@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// error responses are RFC 7807 problem details, the type identifies the kind of problem
+// and is relative to the API, e.g. /problems/validation-error
+const problemContentType = "application/problem+json"
+
+// problem types
+const (
+	problemTypeValidation       = "/problems/validation-error"
+	problemTypeUnauthorized     = "/problems/unauthorized"
+	problemTypeForbidden        = "/problems/forbidden"
+	problemTypeNotFound         = "/problems/not-found"
+	problemTypeMethodNotAllowed = "/problems/method-not-allowed"
+	problemTypeBodyTooLarge     = "/problems/body-too-large"
+	problemTypeRateLimited      = "/problems/rate-limited"
+	problemTypeQuotaExceeded    = "/problems/quota-exceeded"
+	problemTypeInternal         = "/problems/internal-error"
+)
+
+// default problem type for each status
+var problemTypes = map[int]string{
+	http.StatusBadRequest:            problemTypeValidation,
+	http.StatusUnauthorized:          problemTypeUnauthorized,
+	http.StatusForbidden:             problemTypeForbidden,
+	http.StatusNotFound:              problemTypeNotFound,
+	http.StatusMethodNotAllowed:      problemTypeMethodNotAllowed,
+	http.StatusRequestEntityTooLarge: problemTypeBodyTooLarge,
+	http.StatusTooManyRequests:       problemTypeRateLimited,
+	http.StatusInternalServerError:   problemTypeInternal,
+}
+
+// RFC 7807 problem details, extended with the request ID and field level errors
+type problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	RequestID string       `json:"requestId,omitempty"`
+	Errors    []fieldError `json:"errors,omitempty"`
+}
+
+// a problem with one field of the request
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// function to create a problem for the status, using the default type for the status
+func newProblem(status int, detail string) problem {
+	problemType, found := problemTypes[status]
+	if !found {
+		problemType = "about:blank"
+	}
+	return problem{Type: problemType, Title: http.StatusText(status), Status: status, Detail: detail}
+}
+
+// function to write a problem response
+func writeProblem(w http.ResponseWriter, r *http.Request, p problem) {
+	p.Instance = r.URL.Path
+	p.RequestID = requestIDFromContext(r.Context())
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		loggerFromContext(r.Context()).Error("error encoding problem response", "error", err)
+	}
+}
+
+// function to write a problem response for the status with the default type
+func writeError(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	writeProblem(w, r, newProblem(status, detail))
+}
+
+// function to respond with 500 instead of dropping the connection when a handler panics
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+				loggerFromContext(r.Context()).Error("panic serving request", "panic", recovered)
+				writeError(w, r, http.StatusInternalServerError, "")
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// function to create the handler for requests to a route with a method it does not support
+// the methods the path does support are listed in the Allow header
+func methodNotAllowed(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+			methods, err := route.GetMethods()
+			if err != nil {
+				return nil
+			}
+			for _, method := range methods {
+				probe := r.Clone(r.Context())
+				probe.Method = method
+				if route.Match(probe, &mux.RouteMatch{}) {
+					allowed = append(allowed, method)
+				}
+			}
+			return nil
+		})
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, r, http.StatusMethodNotAllowed, "method "+r.Method+" is not allowed for "+r.URL.Path)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProblemResponses(t *testing.T) {
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"problem-user"})
+	router := newRouter()
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		apiKey         string
+		body           string
+		expectedStatus int
+		expectedType   string
+		expectedField  string
+	}{
+		{"unknown route", "GET", "/unknown", "problem-user", "", http.StatusNotFound, problemTypeNotFound, ""},
+		{"unknown receipt", "GET", "/receipts/abc/points", "problem-user", "", http.StatusNotFound, problemTypeNotFound, ""},
+		{"unauthorized", "GET", "/receipts/abc/points", "bad-key", "", http.StatusUnauthorized, problemTypeUnauthorized, ""},
+		{"forbidden", "GET", "/admin/audit", "problem-user", "", http.StatusForbidden, problemTypeForbidden, ""},
+		{"method not allowed", "DELETE", "/receipts/process", "problem-user", "", http.StatusMethodNotAllowed, problemTypeMethodNotAllowed, ""},
+		{"unknown field", "POST", "/receipts/process", "problem-user", `{"coupon":"FREE"}`, http.StatusBadRequest, problemTypeValidation, "coupon"},
+		{"wrong type", "POST", "/receipts/process", "problem-user", `{"total":1}`, http.StatusBadRequest, problemTypeValidation, "total"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		req.Header.Set("Authorization", test.apiKey)
+		req.Header.Set(requestIDHeader, "problem-request")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != test.expectedStatus {
+			t.Errorf("%s: expected status code %d, got %d", test.name, test.expectedStatus, rr.Code)
+		}
+		if contentType := rr.Header().Get("Content-Type"); contentType != problemContentType {
+			t.Errorf("%s: expected content type %s, got %s", test.name, problemContentType, contentType)
+		}
+		var p problem
+		if err := json.NewDecoder(rr.Body).Decode(&p); err != nil {
+			t.Fatalf("%s: error decoding problem: %v", test.name, err)
+		}
+		if p.Type != test.expectedType || p.Status != test.expectedStatus || p.Title != http.StatusText(test.expectedStatus) ||
+			p.RequestID != "problem-request" || p.Instance != test.path || p.Detail == "" {
+			t.Errorf("%s: unexpected problem %+v", test.name, p)
+		}
+		if test.expectedField != "" && (len(p.Errors) != 1 || p.Errors[0].Field != test.expectedField) {
+			t.Errorf("%s: expected an error for field %s, got %+v", test.name, test.expectedField, p.Errors)
+		}
+		if test.expectedStatus == http.StatusMethodNotAllowed && rr.Header().Get("Allow") != "POST" {
+			t.Errorf("%s: expected Allow POST, got %q", test.name, rr.Header().Get("Allow"))
+		}
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	handler := requestIDs(recoverPanics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("scoring exploded")
+	})))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/receipts/abc/points", nil))
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status code %d, got %d", http.StatusInternalServerError, rr.Code)
+	}
+	var p problem
+	if err := json.NewDecoder(rr.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Type != problemTypeInternal || strings.Contains(p.Detail, "exploded") {
+		t.Errorf("Unexpected problem %+v", p)
+	}
+}
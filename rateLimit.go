@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limits applied to a single caller
+// token bucket refilled at RequestsPerSecond up to Burst (0 = unlimited), DailyQuota caps receipts processed per UTC day (0 = unlimited)
+type rateLimit struct {
+	RequestsPerSecond float64
+	Burst             int
+	DailyQuota        int
+}
+
+// function to check the limits can be enforced
+func (l rateLimit) validate() error {
+	switch {
+	case math.IsNaN(l.RequestsPerSecond) || math.IsInf(l.RequestsPerSecond, 0) || l.RequestsPerSecond < 0:
+		return errors.New("requests per second must be 0 (unlimited) or more")
+	case l.RequestsPerSecond > 0 && l.Burst < 1:
+		return errors.New("burst must be at least 1")
+	case l.DailyQuota < 0:
+		return errors.New("daily quota must be 0 (unlimited) or more")
+	}
+	return nil
+}
+
+// limits used for callers without an override, set from command line flags
+var defaultRateLimit = rateLimit{RequestsPerSecond: 10, Burst: 20, DailyQuota: 10000}
+
+// per key limits keyed by key ID, set from the -keyratelimits command line flag
+var RateLimits = map[string]rateLimit{}
+
+// flag value for RateLimits in the form "key-4e9091c123d8=50:100:0,partner1=5:10:1000",
+// each key ID's requests per second, burst and daily quota, setting it replaces every override
+type keyRateLimitsFlag struct{}
+
+func (keyRateLimitsFlag) String() string {
+	overrides := make([]string, 0, len(RateLimits))
+	for keyID, limit := range RateLimits {
+		overrides = append(overrides, fmt.Sprintf("%s=%s:%d:%d", keyID, strconv.FormatFloat(limit.RequestsPerSecond, 'f', -1, 64), limit.Burst, limit.DailyQuota))
+	}
+	slices.Sort(overrides)
+	return strings.Join(overrides, ",")
+}
+
+func (keyRateLimitsFlag) Set(value string) error {
+	limits := map[string]rateLimit{}
+	for _, override := range strings.Split(value, ",") {
+		if strings.TrimSpace(override) == "" {
+			continue
+		}
+		keyID, setting, _ := strings.Cut(strings.TrimSpace(override), "=")
+		parts := strings.Split(setting, ":")
+		if keyID == "" || len(parts) != 3 {
+			return fmt.Errorf("%q must be in the form keyId=requestsPerSecond:burst:dailyQuota", override)
+		}
+		var limit rateLimit
+		var errs [3]error
+		limit.RequestsPerSecond, errs[0] = strconv.ParseFloat(parts[0], 64)
+		limit.Burst, errs[1] = strconv.Atoi(parts[1])
+		limit.DailyQuota, errs[2] = strconv.Atoi(parts[2])
+		if err := errors.Join(errs[:]...); err != nil {
+			return fmt.Errorf("%q must be in the form keyId=requestsPerSecond:burst:dailyQuota", override)
+		}
+		if err := limit.validate(); err != nil {
+			return fmt.Errorf("%s: %w", keyID, err)
+		}
+		limits[keyID] = limit
+	}
+	RateLimits = limits
+	return nil
+}
+
+var limiter = newRateLimiter()
+
+// how long an idle token bucket is kept before being discarded
+const idleBucketTTL = 10 * time.Minute
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+type dailyQuota struct {
+	day   string
+	count int
+}
+
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	quotas    map[string]*dailyQuota
+	lastPrune time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		quotas:  make(map[string]*dailyQuota),
+	}
+}
+
+// function to look up the limits for a caller, falling back to the defaults
+func limitFor(caller string) rateLimit {
+	if limit, found := RateLimits[caller]; found {
+		return limit
+	}
+	return defaultRateLimit
+}
+
+// function to identify the caller for rate limiting
+// authenticated requests are limited per key ID, otherwise (e.g. -noauth mode) per client IP
+func rateLimitCaller(r *http.Request) string {
+	if identity := identityFromRequest(r); identity != "" {
+		return identity
+	}
+	return "ip:" + clientIP(r)
+}
+
+// function to get the IP address of the connected client
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allow takes a token from the callers bucket
+// returns whether the request is allowed, the tokens remaining and how long until a token is available
+func (l *rateLimiter) allow(caller string, limit rateLimit) (bool, int, time.Duration) {
+	if limit.RequestsPerSecond <= 0 {
+		return true, limit.Burst, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.pruneIdle(now)
+	bucket, found := l.buckets[caller]
+	if !found {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), lastSeen: now}
+		l.buckets[caller] = bucket
+	}
+	bucket.tokens = math.Min(float64(limit.Burst), bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*limit.RequestsPerSecond)
+	bucket.lastSeen = now
+
+	if bucket.tokens < 1 {
+		wait := time.Duration((1 - bucket.tokens) / limit.RequestsPerSecond * float64(time.Second))
+		return false, 0, wait
+	}
+	bucket.tokens--
+	return true, int(bucket.tokens), 0
+}
+
+// reserveQuota counts a receipt against the callers daily quota
+// returns whether the receipt is allowed and the receipts remaining for the day
+func (l *rateLimiter) reserveQuota(caller string, limit rateLimit) (bool, int) {
+	if limit.DailyQuota <= 0 {
+		return true, -1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	today := time.Now().UTC().Format("2006-01-02")
+	quota, found := l.quotas[caller]
+	if !found || quota.day != today {
+		quota = &dailyQuota{day: today}
+		l.quotas[caller] = quota
+	}
+	if quota.count >= limit.DailyQuota {
+		return false, 0
+	}
+	quota.count++
+	return true, limit.DailyQuota - quota.count
+}
+
+// pruneIdle drops buckets that have been idle long enough to have refilled, caller must hold the lock
+func (l *rateLimiter) pruneIdle(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	for caller, bucket := range l.buckets {
+		if now.Sub(bucket.lastSeen) > idleBucketTTL {
+			delete(l.buckets, caller)
+		}
+	}
+	today := now.UTC().Format("2006-01-02")
+	for caller, quota := range l.quotas {
+		if quota.day != today {
+			delete(l.quotas, caller)
+		}
+	}
+}
+
+// function to get the time until daily quotas reset at midnight UTC
+func untilQuotaReset() time.Duration {
+	now := time.Now().UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return midnight.Sub(now)
+}
+
+// function to handle per caller rate limiting, must run after authentication
+func rateLimitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller := rateLimitCaller(r)
+		limit := limitFor(caller)
+		if limit.RequestsPerSecond <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowed, remaining, wait := limiter.allow(caller, limit)
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		// seconds until the bucket is full again
+		reset := math.Ceil((float64(limit.Burst) - float64(remaining)) / limit.RequestsPerSecond)
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(reset)))
+		if !allowed {
+			loggerFromContext(r.Context()).Warn("rate limit exceeded", "caller", caller)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, r, http.StatusTooManyRequests, "rate limit exceeded, retry after "+w.Header().Get("Retry-After")+" seconds")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// function to count a receipt against the callers daily quota, once it has been decoded and validated
+// so rejected receipts are not counted, writes a 429 problem and returns false when the quota is used up
+func reserveReceiptQuota(w http.ResponseWriter, r *http.Request) bool {
+	caller := rateLimitCaller(r)
+	limit := limitFor(caller)
+	allowed, remaining := limiter.reserveQuota(caller, limit)
+	if limit.DailyQuota > 0 {
+		w.Header().Set("X-Quota-Limit", strconv.Itoa(limit.DailyQuota))
+		w.Header().Set("X-Quota-Remaining", strconv.Itoa(remaining))
+	}
+	if !allowed {
+		loggerFromContext(r.Context()).Warn("daily receipt quota exceeded", "caller", caller)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(untilQuotaReset().Seconds()))))
+		p := newProblem(http.StatusTooManyRequests, "daily receipt quota exceeded, quotas reset at midnight UTC")
+		p.Type = problemTypeQuotaExceeded
+		writeProblem(w, r, p)
+		return false
+	}
+	return true
+}
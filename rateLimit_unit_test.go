@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimitRequests(t *testing.T) {
+	limiter = newRateLimiter()
+	RateLimits["key-limited"] = rateLimit{RequestsPerSecond: 1, Burst: 2}
+	defer delete(RateLimits, "key-limited")
+
+	handler := rateLimitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	newRequest := func(keyID string) *http.Request {
+		req := httptest.NewRequest("GET", "/receipts/abc/points", nil)
+		if keyID != "" {
+			req = withIdentity(req, keyID)
+		}
+		return req
+	}
+
+	// burst allowed, then limited
+	for i, expectedRemaining := range []string{"1", "0"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, newRequest("key-limited"))
+		if rr.Code != http.StatusOK {
+			t.Errorf("Request %d: expected status code %d, got %d", i, http.StatusOK, rr.Code)
+		}
+		if rr.Header().Get("X-RateLimit-Remaining") != expectedRemaining {
+			t.Errorf("Request %d: expected remaining %s, got %s", i, expectedRemaining, rr.Header().Get("X-RateLimit-Remaining"))
+		}
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, newRequest("key-limited"))
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected Retry-After 1, got %q", rr.Header().Get("Retry-After"))
+	}
+	if rr.Header().Get("X-RateLimit-Limit") != "2" {
+		t.Errorf("Expected X-RateLimit-Limit 2, got %q", rr.Header().Get("X-RateLimit-Limit"))
+	}
+
+	// other callers have their own bucket, unauthenticated callers are limited by IP
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, newRequest("key-other"))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+	if caller := rateLimitCaller(newRequest("")); caller != "ip:192.0.2.1" {
+		t.Errorf("Expected caller ip:192.0.2.1, got %s", caller)
+	}
+}
+
+func TestReserveReceiptQuota(t *testing.T) {
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"quota-user"})
+	keyID := APIKeys["quota-user"]
+	RateLimits[keyID] = rateLimit{RequestsPerSecond: 100, Burst: 100, DailyQuota: 2}
+	defer delete(RateLimits, keyID)
+	router := newRouter()
+	valid := `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[],"total":"6.49"}`
+
+	// rejected receipts do not count against the quota
+	for _, body := range []string{"", `{"coupon":"FREE"}`} {
+		if rr := sendRequest(router, "POST", "/v1/receipts/process", "quota-user", body, nil); rr.Code != http.StatusBadRequest || rr.Header().Get("X-Quota-Remaining") != "" {
+			t.Errorf("Expected status code %d without using the quota, got %d %q", http.StatusBadRequest, rr.Code, rr.Header().Get("X-Quota-Remaining"))
+		}
+	}
+	for i, expectedRemaining := range []string{"1", "0"} {
+		rr := sendRequest(router, "POST", "/v1/receipts/process", "quota-user", valid, nil)
+		if rr.Code != http.StatusOK || rr.Header().Get("X-Quota-Remaining") != expectedRemaining {
+			t.Errorf("Request %d: expected status code %d with %s remaining, got %d %q", i, http.StatusOK, expectedRemaining, rr.Code, rr.Header().Get("X-Quota-Remaining"))
+		}
+	}
+	rr := sendRequest(router, "POST", "/v1/receipts/process", "quota-user", valid, nil)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status code %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected Retry-After header to be set")
+	}
+	if rr.Header().Get("X-Quota-Remaining") != "0" {
+		t.Errorf("Expected X-Quota-Remaining 0, got %q", rr.Header().Get("X-Quota-Remaining"))
+	}
+}
+
+func TestUnlimitedRate(t *testing.T) {
+	limiter = newRateLimiter()
+	RateLimits["key-unlimited"] = rateLimit{RequestsPerSecond: 0, Burst: 0}
+	defer delete(RateLimits, "key-unlimited")
+
+	handler := rateLimitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 50; i++ {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, withIdentity(httptest.NewRequest("GET", "/receipts/abc/points", nil), "key-unlimited"))
+		if rr.Code != http.StatusOK || rr.Header().Get("X-RateLimit-Reset") != "" {
+			t.Fatalf("Request %d: expected status code %d without rate limit headers, got %d %v", i, http.StatusOK, rr.Code, rr.Header())
+		}
+	}
+}
+
+func TestKeyRateLimitsFlag(t *testing.T) {
+	saved := RateLimits
+	defer func() { RateLimits = saved }()
+
+	if err := (keyRateLimitsFlag{}).Set("key-b=0.5:1:0, key-a=50:100:1000"); err != nil {
+		t.Fatalf("Error setting key rate limits: %v", err)
+	}
+	if limit := RateLimits["key-b"]; limit != (rateLimit{RequestsPerSecond: 0.5, Burst: 1}) {
+		t.Errorf("Unexpected limit %+v", limit)
+	}
+	if value := (keyRateLimitsFlag{}).String(); value != "key-a=50:100:1000,key-b=0.5:1:0" {
+		t.Errorf("Expected %s, got %s", "key-a=50:100:1000,key-b=0.5:1:0", value)
+	}
+	for _, value := range []string{"key-a=5:10", "key-a=fast:10:0", "=5:10:0", "key-a=-1:10:0", "key-a=5:0:0", "key-a=5:10:-1", "key-a=NaN:10:0"} {
+		if err := (keyRateLimitsFlag{}).Set(value); err == nil {
+			t.Errorf("%s: expected an error", value)
+		}
+	}
+	// invalid settings leave the limits unchanged
+	if len(RateLimits) != 2 {
+		t.Errorf("Expected %d, got %d", 2, len(RateLimits))
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// longest reason accepted when deleting a receipt
+const maxDeleteReasonLength = 500
+
+// content types accepted for PATCH, the body is a JSON merge patch (RFC 7396)
+const mergePatchContentType = "application/merge-patch+json"
+
+// when, by whom and why a receipt was soft deleted
+type receiptDeletion struct {
+	DeletedAt time.Time `json:"deletedAt"`
+	DeletedBy string    `json:"deletedBy,omitempty"` // key ID
+	Reason    string    `json:"reason"`
+}
+
+// earlier revision of a corrected receipt, as it was submitted and scored
+type receiptRevision struct {
+	Revision         int         `json:"revision"`
+	Retailer         string      `json:"retailer"`
+	PurchaseDate     string      `json:"purchaseDate"`
+	PurchaseTime     string      `json:"purchaseTime"`
+	Items            []Item      `json:"items"`
+	Total            string      `json:"total"`
+	Points           int         `json:"points"`
+	CalculationError bool        `json:"calculationError"`
+	Breakdown        []ruleScore `json:"breakdown,omitempty"`
+	ReplacedAt       *time.Time  `json:"replacedAt,omitempty"`
+	ReplacedBy       string      `json:"replacedBy,omitempty"` // key ID of the correction
+}
+
+// serializes corrections and deletions so no revision is lost to concurrent updates of a receipt
+var receiptUpdates sync.Mutex
+
+func newReceiptRevision(receipt Receipt) receiptRevision {
+	return receiptRevision{
+		Revision:         len(receipt.Revisions) + 1,
+		Retailer:         receipt.Retailer,
+		PurchaseDate:     receipt.PurchaseDate,
+		PurchaseTime:     receipt.PurchaseTime,
+		Items:            receipt.Items,
+		Total:            receipt.Total,
+		Points:           receipt.Points,
+		CalculationError: receipt.CalulationErr,
+		Breakdown:        receipt.Breakdown,
+	}
+}
+
+// function to look up a receipt
+func GetReceiptV2(w http.ResponseWriter, r *http.Request) {
+	receipt, found := findTenantReceipt(w, r)
+	if !found || receiptNotModified(w, r, receipt) {
+		return
+	}
+	writeJSON(w, r, http.StatusOK, newReceiptV2(receipt))
+}
+
+// function to list every revision of a receipt, oldest first, with the points change made by each correction
+func GetReceiptRevisionsV2(w http.ResponseWriter, r *http.Request) {
+	receipt, found := findTenantReceipt(w, r)
+	if !found || receiptNotModified(w, r, receipt) {
+		return
+	}
+	type revisionResponse struct {
+		receiptRevision
+		PointsChange int `json:"pointsChange"`
+	}
+	response := struct {
+		ID        string             `json:"id"`
+		Revisions []revisionResponse `json:"revisions"`
+	}{
+		ID: receipt.ID,
+	}
+	revisions := append(receipt.Revisions[:len(receipt.Revisions):len(receipt.Revisions)], newReceiptRevision(receipt))
+	for i, revision := range revisions {
+		change := 0
+		if i > 0 {
+			change = revision.Points - revisions[i-1].Points
+		}
+		if revision.Items == nil {
+			revision.Items = []Item{}
+		}
+		response.Revisions = append(response.Revisions, revisionResponse{receiptRevision: revision, PointsChange: change})
+	}
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// function to replace a receipt with a corrected receipt
+func CorrectReceiptV2(w http.ResponseWriter, r *http.Request) {
+	corrected, err := decodeReceipt(r)
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	receiptUpdates.Lock()
+	defer receiptUpdates.Unlock()
+	current, found := findReceipt(w, r)
+	if !found || !receiptPreconditionMet(w, r, current) {
+		return
+	}
+	saveCorrection(w, r, current, corrected)
+}
+
+// function to correct some fields of a receipt with a JSON merge patch (RFC 7396)
+// e.g. {"total": "35.35"}, arrays such as items are replaced as a whole
+func PatchReceiptV2(w http.ResponseWriter, r *http.Request) {
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, _ := mime.ParseMediaType(contentType)
+		if mediaType != mergePatchContentType && mediaType != "application/json" {
+			writeError(w, r, http.StatusUnsupportedMediaType, "request body must be a JSON merge patch ("+mergePatchContentType+")")
+			return
+		}
+	}
+	var patch map[string]interface{}
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&patch); err != nil {
+		writeRequestError(w, r, decodeError(err))
+		return
+	}
+	if err := decoder.Decode(&struct{}{}); err != io.EOF || patch == nil {
+		writeRequestError(w, r, &requestError{Status: http.StatusBadRequest, Message: "request body must contain a single JSON object"})
+		return
+	}
+
+	receiptUpdates.Lock()
+	defer receiptUpdates.Unlock()
+	current, found := findReceipt(w, r)
+	if !found || !receiptPreconditionMet(w, r, current) {
+		return
+	}
+	document := map[string]interface{}{}
+	data, _ := json.Marshal(newReceiptInput(current))
+	json.Unmarshal(data, &document)
+	mergePatch(document, patch)
+	data, _ = json.Marshal(document)
+	corrected, err := decodeReceiptBody(bytes.NewReader(data))
+	if err != nil {
+		writeRequestError(w, r, err)
+		return
+	}
+	saveCorrection(w, r, current, corrected)
+}
+
+// function to apply a JSON merge patch to a decoded JSON object, null removes a member
+func mergePatch(target map[string]interface{}, patch map[string]interface{}) {
+	for key, value := range patch {
+		if value == nil {
+			delete(target, key)
+			continue
+		}
+		if patchObject, ok := value.(map[string]interface{}); ok {
+			targetObject, ok := target[key].(map[string]interface{})
+			if !ok {
+				targetObject = map[string]interface{}{}
+			}
+			mergePatch(targetObject, patchObject)
+			target[key] = targetObject
+			continue
+		}
+		target[key] = value
+	}
+}
+
+// function to score and save a corrected receipt, the current receipt is kept as a revision
+// the caller must hold receiptUpdates
+func saveCorrection(w http.ResponseWriter, r *http.Request, current Receipt, corrected Receipt) {
+	revision := newReceiptRevision(current)
+	replacedAt := time.Now().UTC()
+	revision.ReplacedAt, revision.ReplacedBy = &replacedAt, identityFromRequest(r)
+	corrected.ID, corrected.Tenant = current.ID, current.Tenant
+	corrected.Revisions = append(current.Revisions[:len(current.Revisions):len(current.Revisions)], revision)
+	corrected.Points = CalculatePoints(r.Context(), &corrected)
+	corrected.UpdatedAt = replacedAt
+
+	_, span := startStoreSpan(r.Context(), "save", corrected.ID)
+	err := store.Save(corrected)
+	span.End()
+	if err != nil {
+		loggerFromContext(r.Context()).Error("error saving receipt", "receiptId", corrected.ID, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	receiptsCorrectedTotal.Inc()
+	publishReceiptEvents(corrected, &current)
+	loggerFromContext(r.Context()).Info("receipt corrected", "receiptId", corrected.ID, "revision", len(corrected.Revisions)+1,
+		"previousPoints", current.Points, "points", corrected.Points)
+	setReceiptValidators(w, corrected)
+	writeJSON(w, r, http.StatusOK, newReceiptV2(corrected))
+}
+
+// function to soft delete a receipt, the body gives the reason, e.g. {"reason": "duplicate submission"}
+// deleted receipts are kept in the store but no longer returned by any API
+func DeleteReceiptV2(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeRequestError(w, r, decodeError(err))
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" || utf8.RuneCountInString(req.Reason) > maxDeleteReasonLength {
+		p := newProblem(http.StatusBadRequest, "a reason is required to delete a receipt")
+		p.Errors = []fieldError{{Field: "reason", Message: "must be between 1 and 500 characters"}}
+		writeProblem(w, r, p)
+		return
+	}
+
+	receiptUpdates.Lock()
+	defer receiptUpdates.Unlock()
+	receipt, found := findReceipt(w, r)
+	if !found || !receiptPreconditionMet(w, r, receipt) {
+		return
+	}
+	receipt.Deleted = &receiptDeletion{DeletedAt: time.Now().UTC(), DeletedBy: identityFromRequest(r), Reason: req.Reason}
+	receipt.UpdatedAt = receipt.Deleted.DeletedAt
+	_, span := startStoreSpan(r.Context(), "save", receipt.ID)
+	err := store.Save(receipt)
+	span.End()
+	if err != nil {
+		loggerFromContext(r.Context()).Error("error saving receipt", "receiptId", receipt.ID, "error", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	receiptsDeletedTotal.Inc()
+	loggerFromContext(r.Context()).Info("receipt deleted", "receiptId", receipt.ID, "reason", req.Reason)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCorrectAndDeleteReceipts(t *testing.T) {
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"correct-user", "correct-other", "correct-admin"})
+	adminID := APIKeys["correct-admin"]
+	AdminKeyIDs[adminID] = true
+	defer delete(AdminKeyIDs, adminID)
+	router := newRouter()
+
+	decodeReceipt := func(rr *httptest.ResponseRecorder) receiptV2 {
+		var receipt receiptV2
+		if err := json.NewDecoder(rr.Body).Decode(&receipt); err != nil {
+			t.Fatal(err)
+		}
+		return receipt
+	}
+
+	rr := sendRequest(router, "POST", "/v2/receipts/process", "correct-user", `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[{"shortDescription":"Mountain Dew 12PK","price":"6.49"}],"total":"6.49"}`, nil)
+	original := decodeReceipt(rr)
+	path := "/v2/receipts/" + original.ID
+
+	rr = sendRequest(router, "GET", path, "correct-user", "", nil)
+	if receipt := decodeReceipt(rr); rr.Code != http.StatusOK || receipt.Revision != 1 || receipt.Total != "6.49" {
+		t.Fatalf("Expected revision 1 of the receipt, got %d %+v", rr.Code, receipt)
+	}
+
+	// other keys cannot read the receipt, admins can
+	for _, test := range []struct {
+		path           string
+		apiKey         string
+		expectedStatus int
+	}{
+		{path, "correct-other", http.StatusNotFound},
+		{path + "/revisions", "correct-other", http.StatusNotFound},
+		{path, "correct-admin", http.StatusOK},
+		{path + "/revisions", "correct-admin", http.StatusOK},
+	} {
+		if rr := sendRequest(router, "GET", test.path, test.apiKey, "", nil); rr.Code != test.expectedStatus {
+			t.Errorf("%s as %s: expected status code %d, got %d", test.path, test.apiKey, test.expectedStatus, rr.Code)
+		}
+	}
+
+	// only admin keys can correct or delete receipts
+	for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+		if rr := sendRequest(router, method, path, "correct-user", `{}`, nil); rr.Code != http.StatusForbidden {
+			t.Errorf("%s: expected status code %d, got %d", method, http.StatusForbidden, rr.Code)
+		}
+	}
+
+	// a round total is worth 75 more points
+	rr = sendRequest(router, "PUT", path, "correct-admin", `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[{"shortDescription":"Mountain Dew 12PK","price":"6.49"}],"total":"7.00"}`, nil)
+	corrected := decodeReceipt(rr)
+	if rr.Code != http.StatusOK || corrected.ID != original.ID || corrected.Revision != 2 || corrected.Points != original.Points+75 {
+		t.Errorf("Expected revision 2 with %d points, got %d %+v", original.Points+75, rr.Code, corrected)
+	}
+
+	// a purchase between 2pm and 4pm is worth 10 more points, the rest of the receipt is unchanged
+	rr = sendRequest(router, "PATCH", path, "correct-admin", `{"purchaseTime":"14:30"}`, map[string]string{"Content-Type": mergePatchContentType})
+	patched := decodeReceipt(rr)
+	if rr.Code != http.StatusOK || patched.Revision != 3 || patched.Points != corrected.Points+10 || patched.Total != "7.00" || len(patched.Items) != 1 {
+		t.Errorf("Expected revision 3 with %d points, got %d %+v", corrected.Points+10, rr.Code, patched)
+	}
+
+	// rejected corrections do not add revisions
+	rejected := []struct {
+		method         string
+		contentType    string
+		body           string
+		expectedStatus int
+	}{
+		{"PUT", "", `{"coupon":"FREE"}`, http.StatusBadRequest},
+		{"PATCH", mergePatchContentType, `{"coupon":"FREE"}`, http.StatusBadRequest},
+		{"PATCH", mergePatchContentType, `{"points":1000}`, http.StatusBadRequest},
+		{"PATCH", mergePatchContentType, `{"total":7}`, http.StatusBadRequest},
+		{"PATCH", mergePatchContentType, `[]`, http.StatusBadRequest},
+		{"PATCH", "application/json-patch+json", `[{"op":"remove","path":"/total"}]`, http.StatusUnsupportedMediaType},
+	}
+	for _, test := range rejected {
+		if rr := sendRequest(router, test.method, path, "correct-admin", test.body, map[string]string{"Content-Type": test.contentType}); rr.Code != test.expectedStatus {
+			t.Errorf("%s %s: expected status code %d, got %d", test.method, test.body, test.expectedStatus, rr.Code)
+		}
+	}
+
+	// the original submission and each points change are kept
+	rr = sendRequest(router, "GET", path+"/revisions", "correct-user", "", nil)
+	var history struct {
+		Revisions []struct {
+			Revision     int    `json:"revision"`
+			Total        string `json:"total"`
+			PurchaseTime string `json:"purchaseTime"`
+			PointsChange int    `json:"pointsChange"`
+			ReplacedBy   string `json:"replacedBy"`
+		} `json:"revisions"`
+	}
+	json.NewDecoder(rr.Body).Decode(&history)
+	if len(history.Revisions) != 3 {
+		t.Fatalf("Expected %d, got %d", 3, len(history.Revisions))
+	}
+	for i, expected := range []struct {
+		total, purchaseTime, replacedBy string
+		pointsChange                    int
+	}{
+		{"6.49", "13:01", adminID, 0},
+		{"7.00", "13:01", adminID, 75},
+		{"7.00", "14:30", "", 10},
+	} {
+		revision := history.Revisions[i]
+		if revision.Revision != i+1 || revision.Total != expected.total || revision.PurchaseTime != expected.purchaseTime ||
+			revision.ReplacedBy != expected.replacedBy || revision.PointsChange != expected.pointsChange {
+			t.Errorf("Unexpected revision %d: %+v", i+1, revision)
+		}
+	}
+
+	// deleting requires a reason
+	if rr := sendRequest(router, "DELETE", path, "correct-admin", `{"reason":"  "}`, nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+	if rr := sendRequest(router, "DELETE", path, "correct-admin", `{"reason":"duplicate submission"}`, nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status code %d, got %d", http.StatusNoContent, rr.Code)
+	}
+
+	// deleted receipts are kept with the reason but no longer returned
+	if receipt, found := store.Get(original.ID); !found || receipt.Deleted == nil || receipt.Deleted.Reason != "duplicate submission" || receipt.Deleted.DeletedBy != adminID {
+		t.Errorf("Expected the deleted receipt to be kept with the reason, got %+v", receipt.Deleted)
+	}
+	deleted, _ := store.Get(original.ID)
+	for _, test := range []struct{ method, path, body string }{
+		{"GET", path, ""},
+		{"GET", path + "/revisions", ""},
+		{"GET", "/v1/receipts/" + original.ID + "/points", ""},
+		{"PUT", path, `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[],"total":"9.00"}`},
+		{"PATCH", path, `{"total":"9.00"}`},
+		{"DELETE", path, `{"reason":"again"}`},
+	} {
+		rr := sendRequest(router, test.method, test.path, "correct-admin", test.body, nil)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("%s %s: expected status code %d, got %d", test.method, test.path, http.StatusNotFound, rr.Code)
+		}
+		// only the problem is written, nothing about the deleted receipt follows it
+		var p problem
+		decoder := json.NewDecoder(rr.Body)
+		if err := decoder.Decode(&p); err != nil || p.Status != http.StatusNotFound || decoder.More() {
+			t.Errorf("%s %s: expected only a problem body, got %s", test.method, test.path, rr.Body.String())
+		}
+		// the deleted receipt is left as it was
+		if receipt, _ := store.Get(original.ID); receipt.Deleted == nil || receipt.Deleted.Reason != deleted.Deleted.Reason || !receipt.Deleted.DeletedAt.Equal(deleted.Deleted.DeletedAt) ||
+			receipt.Total != deleted.Total || len(receipt.Revisions) != len(deleted.Revisions) {
+			t.Errorf("%s %s: expected the deleted receipt to be unchanged, got %+v", test.method, test.path, receipt)
+		}
+	}
+	rr = sendRequest(router, "GET", "/v2/receipts?limit=100&retailer=Target", "correct-user", "", nil)
+	if strings.Contains(rr.Body.String(), original.ID) {
+		t.Errorf("Expected the deleted receipt not to be listed")
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// number of receipts in a page when no limit is given, and the largest limit accepted
+const (
+	defaultReceiptPageSize = 20
+	maxReceiptPageSize     = 100
+)
+
+// receipt list orders, a leading - sorts descending, ties are ordered by ID
+const (
+	receiptSortDate       = "date"
+	receiptSortDateDesc   = "-date"
+	receiptSortPoints     = "points"
+	receiptSortPointsDesc = "-points"
+)
+
+// filters, order and page of a receipt list request, empty values match everything
+type receiptListQuery struct {
+	Retailer         string
+	From             string // purchase date, inclusive
+	To               string // purchase date, inclusive
+	MinPoints        *int
+	MaxPoints        *int
+	CalculationError *bool
+	Sort             string
+	Limit            int
+	After            *receiptCursor
+}
+
+// position of the last receipt of a page, the next page starts after it
+type receiptCursor struct {
+	Sort   string `json:"s"`
+	Date   string `json:"d,omitempty"`
+	Points int    `json:"p,omitempty"`
+	ID     string `json:"i"`
+}
+
+// receipt as listed by v2
+type receiptV2 struct {
+	ID               string      `json:"id"`
+	Retailer         string      `json:"retailer"`
+	PurchaseDate     string      `json:"purchaseDate"`
+	PurchaseTime     string      `json:"purchaseTime"`
+	Items            []Item      `json:"items"`
+	Total            string      `json:"total"`
+	Points           int         `json:"points"`
+	CalculationError bool        `json:"calculationError"`
+	Breakdown        []ruleScore `json:"breakdown"`
+	Revision         int         `json:"revision"`
+}
+
+func newReceiptV2(receipt Receipt) receiptV2 {
+	response := receiptV2{
+		ID:               receipt.ID,
+		Retailer:         receipt.Retailer,
+		PurchaseDate:     receipt.PurchaseDate,
+		PurchaseTime:     receipt.PurchaseTime,
+		Items:            receipt.Items,
+		Total:            receipt.Total,
+		Points:           receipt.Points,
+		CalculationError: receipt.CalulationErr,
+		Breakdown:        receipt.Breakdown,
+		Revision:         len(receipt.Revisions) + 1,
+	}
+	if response.Items == nil {
+		response.Items = []Item{}
+	}
+	if response.Breakdown == nil {
+		response.Breakdown = []ruleScore{}
+	}
+	return response
+}
+
+// function to list the receipts the caller can read, see receiptVisibleTo
+// supports retailer, from and to (purchase dates, inclusive), minPoints, maxPoints, calculationError,
+// sort (date, -date, points or -points), limit and cursor query parameters
+func ListReceiptsV2(w http.ResponseWriter, r *http.Request) {
+	query, fieldErr := parseReceiptListQuery(r.URL.Query())
+	if fieldErr != nil {
+		p := newProblem(http.StatusBadRequest, "invalid query parameter")
+		p.Errors = []fieldError{*fieldErr}
+		writeProblem(w, r, p)
+		return
+	}
+
+	_, span := startStoreSpan(r.Context(), "list", "")
+	receipts := store.List()
+	span.End()
+	receipts = slices.DeleteFunc(receipts, func(receipt Receipt) bool { return !receiptVisibleTo(r.Context(), receipt) })
+	page, next := listReceipts(receipts, query)
+
+	response := struct {
+		Receipts   []receiptV2 `json:"receipts"`
+		NextCursor string      `json:"nextCursor,omitempty"`
+	}{
+		Receipts: make([]receiptV2, 0, len(page)),
+	}
+	for _, receipt := range page {
+		response.Receipts = append(response.Receipts, newReceiptV2(receipt))
+	}
+	if next != nil {
+		response.NextCursor = next.encode()
+	}
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+// function to parse the query parameters of a receipt list request
+func parseReceiptListQuery(params url.Values) (receiptListQuery, *fieldError) {
+	query := receiptListQuery{
+		Retailer: params.Get("retailer"),
+		Sort:     receiptSortDate,
+		Limit:    defaultReceiptPageSize,
+	}
+	for _, name := range []string{"from", "to"} {
+		value := params.Get(name)
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse(time.DateOnly, value); err != nil {
+			return query, &fieldError{Field: name, Message: "must be a date, e.g. 2022-01-01"}
+		}
+		if name == "from" {
+			query.From = value
+		} else {
+			query.To = value
+		}
+	}
+	for name, target := range map[string]**int{"minPoints": &query.MinPoints, "maxPoints": &query.MaxPoints} {
+		if value := params.Get(name); value != "" {
+			points, err := strconv.Atoi(value)
+			if err != nil {
+				return query, &fieldError{Field: name, Message: "must be an integer"}
+			}
+			*target = &points
+		}
+	}
+	if value := params.Get("calculationError"); value != "" {
+		calculationError, err := strconv.ParseBool(value)
+		if err != nil {
+			return query, &fieldError{Field: "calculationError", Message: "must be true or false"}
+		}
+		query.CalculationError = &calculationError
+	}
+	if value := params.Get("sort"); value != "" {
+		switch value {
+		case receiptSortDate, receiptSortDateDesc, receiptSortPoints, receiptSortPointsDesc:
+			query.Sort = value
+		default:
+			return query, &fieldError{Field: "sort", Message: "must be one of date, -date, points or -points"}
+		}
+	}
+	if value := params.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxReceiptPageSize {
+			return query, &fieldError{Field: "limit", Message: "must be an integer between 1 and " + strconv.Itoa(maxReceiptPageSize)}
+		}
+		query.Limit = limit
+	}
+	if value := params.Get("cursor"); value != "" {
+		cursor, err := decodeReceiptCursor(value)
+		if err != nil || cursor.Sort != query.Sort {
+			return query, &fieldError{Field: "cursor", Message: "must be a nextCursor returned for the same sort"}
+		}
+		query.After = cursor
+	}
+	return query, nil
+}
+
+// function to return the page of receipts matching the query
+// and the cursor of the next page, nil when this is the last page
+func listReceipts(receipts []Receipt, query receiptListQuery) ([]Receipt, *receiptCursor) {
+	matches := []Receipt{}
+	for _, receipt := range receipts {
+		if query.matches(receipt) {
+			matches = append(matches, receipt)
+		}
+	}
+	slices.SortFunc(matches, func(a, b Receipt) int {
+		return compareReceiptCursors(newReceiptCursor(a, query.Sort), newReceiptCursor(b, query.Sort))
+	})
+	if query.After != nil {
+		start, _ := slices.BinarySearchFunc(matches, *query.After, func(receipt Receipt, after receiptCursor) int {
+			if compareReceiptCursors(newReceiptCursor(receipt, query.Sort), after) <= 0 {
+				return -1
+			}
+			return 1
+		})
+		matches = matches[start:]
+	}
+	if len(matches) <= query.Limit {
+		return matches, nil
+	}
+	page := matches[:query.Limit]
+	next := newReceiptCursor(page[len(page)-1], query.Sort)
+	return page, &next
+}
+
+func (q receiptListQuery) matches(receipt Receipt) bool {
+	return receipt.Deleted == nil &&
+		(q.Retailer == "" || receipt.Retailer == q.Retailer) &&
+		(q.From == "" || receipt.PurchaseDate >= q.From) &&
+		(q.To == "" || receipt.PurchaseDate <= q.To) &&
+		(q.MinPoints == nil || receipt.Points >= *q.MinPoints) &&
+		(q.MaxPoints == nil || receipt.Points <= *q.MaxPoints) &&
+		(q.CalculationError == nil || receipt.CalulationErr == *q.CalculationError)
+}
+
+func newReceiptCursor(receipt Receipt, sort string) receiptCursor {
+	cursor := receiptCursor{Sort: sort, ID: receipt.ID}
+	switch sort {
+	case receiptSortDate, receiptSortDateDesc:
+		cursor.Date = receipt.PurchaseDate + " " + receipt.PurchaseTime
+	case receiptSortPoints, receiptSortPointsDesc:
+		cursor.Points = receipt.Points
+	}
+	return cursor
+}
+
+// function to compare the positions of two receipts in the order of a's sort
+func compareReceiptCursors(a, b receiptCursor) int {
+	c := strings.Compare(a.Date, b.Date)
+	if c == 0 {
+		c = cmp.Compare(a.Points, b.Points)
+	}
+	if c == 0 {
+		c = strings.Compare(a.ID, b.ID)
+	}
+	if strings.HasPrefix(a.Sort, "-") {
+		return -c
+	}
+	return c
+}
+
+// function to encode a cursor, cursors are opaque to clients
+func (c receiptCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeReceiptCursor(value string) (*receiptCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	var cursor receiptCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListReceipts(t *testing.T) {
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"list-user", "list-admin"})
+	tenant, adminID := APIKeys["list-user"], APIKeys["list-admin"]
+	RateLimits[tenant] = rateLimit{RequestsPerSecond: 1000, Burst: 1000}
+	AdminKeyIDs[adminID] = true
+	defer func() {
+		delete(RateLimits, tenant)
+		delete(AdminKeyIDs, adminID)
+	}()
+	router := newRouter()
+	savedStore := store
+	defer func() { store = savedStore }()
+
+	fileStore, err := openStore(storeBackendFile, filepath.Join(t.TempDir(), "receipts.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fileStore.Close()
+
+	receipts := []Receipt{
+		{ID: "a", Retailer: "Target", PurchaseDate: "2022-01-01", PurchaseTime: "13:01", Points: 28, Tenant: tenant},
+		{ID: "b", Retailer: "Target", PurchaseDate: "2022-01-02", PurchaseTime: "09:00", Points: 10, Tenant: tenant},
+		{ID: "c", Retailer: "M&M Corner Market", PurchaseDate: "2022-03-20", PurchaseTime: "14:33", Points: 109, Tenant: tenant},
+		{ID: "d", Retailer: "Target", PurchaseDate: "2022-01-01", PurchaseTime: "08:15", Points: 0, CalulationErr: true, Tenant: tenant},
+		{ID: "e", Retailer: "Walmart", PurchaseDate: "2022-02-14", PurchaseTime: "16:00", Points: 28, Tenant: tenant},
+		// submitted by another key, only listed for admins
+		{ID: "f", Retailer: "Target", PurchaseDate: "2022-01-03", PurchaseTime: "10:00", Points: 5, Tenant: "key-other"},
+	}
+
+	// list every page of a request, following the next cursor
+	listAllAs := func(t *testing.T, apiKey, query string) ([]string, int) {
+		var ids []string
+		pages := 0
+		path := "/v2/receipts?" + query
+		for {
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set("Authorization", apiKey)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("%s: expected status code %d, got %d %s", path, http.StatusOK, rr.Code, rr.Body.String())
+			}
+			var page struct {
+				Receipts []receiptV2 `json:"receipts"`
+				Next     string      `json:"nextCursor"`
+			}
+			if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+			pages++
+			for _, receipt := range page.Receipts {
+				ids = append(ids, receipt.ID)
+			}
+			if page.Next == "" {
+				return ids, pages
+			}
+			path = "/v2/receipts?" + query + "&cursor=" + page.Next
+		}
+	}
+	listAll := func(t *testing.T, query string) ([]string, int) {
+		return listAllAs(t, "list-user", query)
+	}
+
+	for name, backend := range map[string]ReceiptStore{"memory": newMemoryStore(), "file": fileStore} {
+		store = backend
+		for _, receipt := range receipts {
+			store.Save(receipt)
+		}
+
+		tests := []struct {
+			query         string
+			expectedIDs   string
+			expectedPages int
+		}{
+			{"", "d,a,b,e,c", 1},
+			{"limit=2", "d,a,b,e,c", 3},
+			{"sort=-date&limit=2", "c,e,b,a,d", 3},
+			{"sort=points&limit=1", "d,b,a,e,c", 5},
+			{"sort=-points&limit=3", "c,e,a,b,d", 2},
+			{"retailer=Target&limit=2", "d,a,b", 2},
+			{"from=2022-01-02&to=2022-02-14", "b,e", 1},
+			{"minPoints=10&maxPoints=28&sort=points", "b,a,e", 1},
+			{"calculationError=true", "d", 1},
+			{"calculationError=false&retailer=Target", "a,b", 1},
+			{"retailer=Unknown", "", 1},
+		}
+		for _, test := range tests {
+			ids, pages := listAll(t, test.query)
+			if strings.Join(ids, ",") != test.expectedIDs || pages != test.expectedPages {
+				t.Errorf("%s %q: expected %s in %d pages, got %v in %d pages", name, test.query, test.expectedIDs, test.expectedPages, ids, pages)
+			}
+		}
+		if ids, _ := listAllAs(t, "list-admin", "retailer=Target"); strings.Join(ids, ",") != "d,a,b,f" {
+			t.Errorf("%s: expected admins to list every tenant, got %v", name, ids)
+		}
+	}
+
+	// invalid query parameters
+	firstPage := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/v2/receipts?limit=1", nil)
+	req.Header.Set("Authorization", "list-user")
+	router.ServeHTTP(firstPage, req)
+	var page struct {
+		Next string `json:"nextCursor"`
+	}
+	json.NewDecoder(firstPage.Body).Decode(&page)
+
+	for _, test := range []struct {
+		query string
+		field string
+	}{
+		{"from=01/01/2022", "from"},
+		{"minPoints=ten", "minPoints"},
+		{"calculationError=maybe", "calculationError"},
+		{"sort=retailer", "sort"},
+		{"limit=0", "limit"},
+		{"limit=101", "limit"},
+		{"cursor=not-a-cursor", "cursor"},
+		{"sort=points&cursor=" + page.Next, "cursor"},
+	} {
+		req := httptest.NewRequest("GET", "/v2/receipts?"+test.query, nil)
+		req.Header.Set("Authorization", "list-user")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		var p problem
+		json.NewDecoder(rr.Body).Decode(&p)
+		if rr.Code != http.StatusBadRequest || len(p.Errors) != 1 || p.Errors[0].Field != test.field {
+			t.Errorf("%q: expected status code %d for field %s, got %d %+v", test.query, http.StatusBadRequest, test.field, rr.Code, p)
+		}
+	}
+}
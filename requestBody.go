@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// command line flags
+var maxBodyBytes int64 = 1 << 20
+var maxReceiptItems = 100
+
+// error returned to the client, the message is safe to expose
+// field is the JSON path of the field at fault, when known, with fieldMessage describing the fault
+type requestError struct {
+	Status       int
+	Message      string
+	Field        string
+	FieldMessage string
+}
+
+func (e *requestError) Error() string {
+	return e.Message
+}
+
+// function to cap the size of request bodies, larger bodies are rejected with 413
+// must run before anything reading the body, such as HMAC authentication
+func limitRequestBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxBodyBytes {
+			writeError(w, r, http.StatusRequestEntityTooLarge, bodyTooLargeMessage())
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func bodyTooLargeMessage() string {
+	return fmt.Sprintf("request body must not be larger than %d bytes", maxBodyBytes)
+}
+
+// fields of a receipt sent by clients, the other Receipt fields are set by the server
+// and are rejected as unknown fields when sent
+type receiptInput struct {
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime"`
+	Items        []Item `json:"items"`
+	Total        string `json:"total"`
+}
+
+func newReceiptInput(receipt Receipt) receiptInput {
+	return receiptInput{
+		Retailer:     receipt.Retailer,
+		PurchaseDate: receipt.PurchaseDate,
+		PurchaseTime: receipt.PurchaseTime,
+		Items:        receipt.Items,
+		Total:        receipt.Total,
+	}
+}
+
+// function to decode a receipt from the request body
+// the body must be a single JSON object with only the client fields and at most maxReceiptItems items,
+// errors have a message that does not echo decoder internals
+func decodeReceipt(r *http.Request) (Receipt, *requestError) {
+	return decodeReceiptBody(r.Body)
+}
+
+// function to decode a receipt from a JSON body, see decodeReceipt
+func decodeReceiptBody(body io.Reader) (Receipt, *requestError) {
+	var input receiptInput
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&input); err != nil {
+		return Receipt{}, decodeError(err)
+	}
+	if err := decoder.Decode(&struct{}{}); err != io.EOF {
+		if tooLarge := decodeError(err); tooLarge.Status == http.StatusRequestEntityTooLarge {
+			return Receipt{}, tooLarge
+		}
+		return Receipt{}, &requestError{Status: http.StatusBadRequest, Message: "request body must contain a single JSON object"}
+	}
+	receipt := Receipt{
+		Retailer:     input.Retailer,
+		PurchaseDate: input.PurchaseDate,
+		PurchaseTime: input.PurchaseTime,
+		Items:        input.Items,
+		Total:        input.Total,
+	}
+	if err := validateReceipt(receipt); err != nil {
+		return Receipt{}, err
+	}
+	return receipt, nil
+}
+
+// function to write a problem response for a request error, with the field at fault when there is one
+func writeRequestError(w http.ResponseWriter, r *http.Request, requestErr *requestError) {
+	loggerFromContext(r.Context()).Info("error decoding request body", "status", requestErr.Status, "error", requestErr)
+	p := newProblem(requestErr.Status, requestErr.Message)
+	if requestErr.Field != "" {
+		p.Errors = []fieldError{{Field: requestErr.Field, Message: requestErr.FieldMessage}}
+	}
+	writeProblem(w, r, p)
+}
+
+// function to validate a decoded receipt, shared by the HTTP and gRPC APIs
+func validateReceipt(receipt Receipt) *requestError {
+	if len(receipt.Items) > maxReceiptItems {
+		return &requestError{Status: http.StatusBadRequest, Message: fmt.Sprintf("receipt must not have more than %d items", maxReceiptItems), Field: "items", FieldMessage: fmt.Sprintf("must not have more than %d items", maxReceiptItems)}
+	}
+	return nil
+}
+
+// function to map a JSON decoding error to a sanitized request error
+func decodeError(err error) *requestError {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var tooLargeErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLargeErr):
+		return &requestError{Status: http.StatusRequestEntityTooLarge, Message: bodyTooLargeMessage()}
+	case errors.Is(err, io.EOF):
+		return &requestError{Status: http.StatusBadRequest, Message: "request body must not be empty"}
+	case errors.As(err, &syntaxErr):
+		return &requestError{Status: http.StatusBadRequest, Message: fmt.Sprintf("request body contains malformed JSON at position %d", syntaxErr.Offset)}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &requestError{Status: http.StatusBadRequest, Message: "request body contains malformed JSON"}
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return &requestError{Status: http.StatusBadRequest, Message: "request body must be a JSON object"}
+		}
+		return &requestError{Status: http.StatusBadRequest, Message: fmt.Sprintf("field %q must be a %s", typeErr.Field, jsonTypeName(typeErr.Type.Kind())), Field: typeErr.Field, FieldMessage: "must be a " + jsonTypeName(typeErr.Type.Kind())}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return &requestError{Status: http.StatusBadRequest, Message: fmt.Sprintf("unknown field %q", field), Field: field, FieldMessage: "unknown field"}
+	}
+	return &requestError{Status: http.StatusBadRequest, Message: "invalid request body"}
+}
+
+// function to name a go kind as the JSON type expected by the client
+func jsonTypeName(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.String:
+		return "string"
+	}
+	return "number"
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeReceipt(t *testing.T) {
+	savedBodyBytes, savedItems := maxBodyBytes, maxReceiptItems
+	maxBodyBytes, maxReceiptItems = 512, 2
+	defer func() { maxBodyBytes, maxReceiptItems = savedBodyBytes, savedItems }()
+	handler := limitRequestBodies(http.HandlerFunc(ProcessReceipts))
+
+	item := `{"shortDescription":"Gum","price":"1.00"}`
+	tests := []struct {
+		name           string
+		body           string
+		chunked        bool
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"valid receipt", `{"retailer":"Target","items":[` + item + `],"total":"1.00"}`, false, http.StatusOK, `"id"`},
+		{"empty body", ``, false, http.StatusBadRequest, "request body must not be empty"},
+		{"malformed JSON", `{"retailer":"Target",}`, false, http.StatusBadRequest, "request body contains malformed JSON at position 22"},
+		{"truncated JSON", `{"retailer":"Target"`, false, http.StatusBadRequest, "request body contains malformed JSON"},
+		{"unknown field", `{"retailer":"Target","coupon":"FREE"}`, false, http.StatusBadRequest, `unknown field "coupon"`},
+		{"server set field", `{"retailer":"Target","points":1000}`, false, http.StatusBadRequest, `unknown field "points"`},
+		{"server set tenant", `{"retailer":"Target","tenant":"key-other"}`, false, http.StatusBadRequest, `unknown field "tenant"`},
+		{"wrong type", `{"retailer":"Target","items":[{"price":1.00}]}`, false, http.StatusBadRequest, `field "items.0.price" must be a string`},
+		{"not an object", `["Target"]`, false, http.StatusBadRequest, "request body must be a JSON object"},
+		{"multiple values", `{"retailer":"Target"}{"retailer":"Walmart"}`, false, http.StatusBadRequest, "request body must contain a single JSON object"},
+		{"trailing garbage", `{"retailer":"Target"} garbage`, false, http.StatusBadRequest, "request body must contain a single JSON object"},
+		{"too many items", `{"retailer":"Target","items":[` + item + `,` + item + `,` + item + `]}`, false, http.StatusBadRequest, "receipt must not have more than 2 items"},
+		{"too large", `{"retailer":"` + strings.Repeat("a", 600) + `"}`, false, http.StatusRequestEntityTooLarge, "request body must not be larger than 512 bytes"},
+		{"too large chunked", `{"retailer":"` + strings.Repeat("a", 600) + `"}`, true, http.StatusRequestEntityTooLarge, "request body must not be larger than 512 bytes"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/receipts/process", strings.NewReader(test.body))
+		if test.chunked {
+			req.ContentLength = -1
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != test.expectedStatus {
+			t.Errorf("%s: expected status code %d, got %d", test.name, test.expectedStatus, rr.Code)
+		}
+		var p problem
+		json.Unmarshal(rr.Body.Bytes(), &p)
+		if rr.Code != http.StatusOK && !strings.Contains(p.Detail, test.expectedBody) {
+			t.Errorf("%s: expected detail containing %q, got %q", test.name, test.expectedBody, rr.Body.String())
+		}
+		if rr.Code == http.StatusOK && !strings.Contains(rr.Body.String(), test.expectedBody) {
+			t.Errorf("%s: expected body containing %q, got %q", test.name, test.expectedBody, rr.Body.String())
+		}
+		if strings.Contains(rr.Body.String(), "json:") {
+			t.Errorf("%s: expected decoder errors not to be exposed, got %q", test.name, rr.Body.String())
+		}
+	}
+}
+
+// function to test oversized signed requests are rejected as too large rather than unauthorized
+func TestSignedRequestTooLarge(t *testing.T) {
+	savedBodyBytes := maxBodyBytes
+	maxBodyBytes = 64
+	defer func() { maxBodyBytes = savedBodyBytes }()
+	HMACSecrets["bodypartner"] = "bodysecret"
+	defer delete(HMACSecrets, "bodypartner")
+	handler := limitRequestBodies(authenticate(http.HandlerFunc(ProcessReceipts)))
+
+	body := fmt.Sprintf(`{"retailer":"%s"}`, strings.Repeat("a", 100))
+	req := newSignedRequest("bodypartner", "bodysecret", "nonce-large", time.Now(), body)
+	req.ContentLength = -1
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status code %d, got %d", http.StatusRequestEntityTooLarge, rr.Code)
+	}
+}
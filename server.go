@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// http server timeouts, set from command line flags
+var readTimeout = 10 * time.Second
+var readHeaderTimeout = 5 * time.Second
+var writeTimeout = 30 * time.Second
+var idleTimeout = 120 * time.Second
+
+// how long in-flight requests are given to complete on SIGINT/SIGTERM
+var shutdownTimeout = 30 * time.Second
+
+// function to serve requests on the listener until ctx is done, e.g. on SIGINT or SIGTERM
+// in-flight requests are then drained, returns an error if the server failed or draining timed out
+func runServer(ctx context.Context, listener net.Listener, handler http.Handler, tlsConfig *tls.Config) error {
+	server := &http.Server{
+		Handler:           handler,
+		TLSConfig:         tlsConfig,
+		ReadTimeout:       readTimeout,
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	// event streams never complete by themselves, they are ended so draining is not held up
+	server.RegisterOnShutdown(receiptEvents.disconnectAll)
+	serverErr := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			serverErr <- server.ServeTLS(listener, "", "")
+		} else {
+			serverErr <- server.Serve(listener)
+		}
+	}()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Info("shutting down, draining in-flight requests", "timeout", shutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("draining in-flight requests: %w", err)
+	}
+	if err := <-serverErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// function to create a context that is done on SIGINT or SIGTERM
+// notification is stopped once the first signal arrives so a second signal stops the process immediately
+func shutdownSignalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+	return ctx, stop
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// function to test in-flight requests complete when the server is stopped, e.g. on SIGTERM
+func TestGracefulShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	serverDone := make(chan error, 1)
+	go func() { serverDone <- runServer(ctx, listener, handler, nil) }()
+
+	responseStatus := make(chan int, 1)
+	go func() {
+		response, err := http.Get("http://" + listener.Addr().String() + "/")
+		if err != nil {
+			t.Errorf("In-flight request failed: %v", err)
+			responseStatus <- 0
+			return
+		}
+		response.Body.Close()
+		responseStatus <- response.StatusCode
+	}()
+
+	<-started
+	stop()
+
+	if status := <-responseStatus; status != http.StatusOK {
+		t.Errorf("Expected %d, got %d", http.StatusOK, status)
+	}
+	select {
+	case err := <-serverDone:
+		if err != nil {
+			t.Errorf("Expected clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server did not shut down")
+	}
+	if _, err := http.Get("http://" + listener.Addr().String() + "/"); err == nil {
+		t.Error("Expected new connections to be refused after shutdown")
+	}
+}
+
+// function to test shutdown reports an error when requests outlive the shutdown timeout
+func TestShutdownTimeout(t *testing.T) {
+	savedTimeout := shutdownTimeout
+	shutdownTimeout = 50 * time.Millisecond
+	defer func() { shutdownTimeout = savedTimeout }()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	defer close(release)
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	serverDone := make(chan error, 1)
+	go func() { serverDone <- runServer(ctx, listener, handler, nil) }()
+	go http.Get("http://" + listener.Addr().String() + "/")
+
+	<-started
+	stop()
+	select {
+	case err := <-serverDone:
+		if err == nil {
+			t.Error("Expected an error when draining times out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server did not shut down")
+	}
+}
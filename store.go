@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ReceiptStore holds processed receipts and their points
+type ReceiptStore interface {
+	Save(receipt Receipt) error
+	Get(id string) (Receipt, bool)
+	Len() int
+	// List returns every stored receipt, in no particular order
+	List() []Receipt
+	// Ping reports whether the store is able to serve requests
+	Ping() error
+	// Close flushes any pending writes before exit
+	Close() error
+}
+
+// storage backends
+const (
+	storeBackendMemory = "memory"
+	storeBackendFile   = "file"
+)
+
+// command line flags
+var storeBackend = storeBackendMemory
+var storeFileName = "data/receipts.jsonl"
+
+// receipt store used by the handlers, replaced with the -store backend at startup
+var store ReceiptStore = newMemoryStore()
+
+// function to open the receipt store for the configured backend
+func openStore(backend string, fileName string) (ReceiptStore, error) {
+	switch backend {
+	case storeBackendMemory:
+		return newMemoryStore(), nil
+	case storeBackendFile:
+		return openFileStore(fileName)
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", backend)
+}
+
+// in memory receipt store, safe for concurrent use
+type memoryStore struct {
+	mu       sync.RWMutex
+	receipts map[string]Receipt
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{receipts: make(map[string]Receipt)}
+}
+
+func (s *memoryStore) Save(receipt Receipt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.receipts[receipt.ID] = receipt
+	return nil
+}
+
+func (s *memoryStore) Get(id string) (Receipt, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	receipt, found := s.receipts[id]
+	return receipt, found
+}
+
+func (s *memoryStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.receipts)
+}
+
+func (s *memoryStore) List() []Receipt {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	receipts := make([]Receipt, 0, len(s.receipts))
+	for _, receipt := range s.receipts {
+		receipts = append(receipts, receipt)
+	}
+	return receipts
+}
+
+func (s *memoryStore) Ping() error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// receipt store persisted to a file of JSON lines, one line per saved receipt
+// receipts are held in memory and the file is replayed on start, the last line for an ID wins
+type fileStore struct {
+	*memoryStore
+	mu   sync.Mutex
+	file *os.File
+}
+
+func openFileStore(fileName string) (*fileStore, error) {
+	s := &fileStore{memoryStore: newMemoryStore()}
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var receipt Receipt
+		if err := json.Unmarshal(scanner.Bytes(), &receipt); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s line %d: %w", fileName, line, err)
+		}
+		s.memoryStore.Save(receipt)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	s.file = file
+	return s, nil
+}
+
+func (s *fileStore) Save(receipt Receipt) error {
+	data, err := json.Marshal(receipt)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return errors.New("receipt store is closed")
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return s.memoryStore.Save(receipt)
+}
+
+func (s *fileStore) Ping() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return errors.New("receipt store is closed")
+	}
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	s.file = nil
+	return err
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// function to test receipts saved to the file store are loaded again when it is reopened
+func TestFileStore(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "receipts.jsonl")
+	fileStore, err := openStore(storeBackendFile, fileName)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	fileStore.Save(Receipt{ID: "r1", Retailer: "Target", Points: 10})
+	fileStore.Save(Receipt{ID: "r2", Retailer: "Walmart", Points: 20})
+	fileStore.Save(Receipt{ID: "r1", Retailer: "Target", Points: 15})
+	if err := fileStore.Close(); err != nil {
+		t.Fatalf("Error closing store: %v", err)
+	}
+	if err := fileStore.Save(Receipt{ID: "r3"}); err == nil {
+		t.Error("Expected an error saving to a closed store")
+	}
+
+	reopened, err := openStore(storeBackendFile, fileName)
+	if err != nil {
+		t.Fatalf("Error reopening store: %v", err)
+	}
+	defer reopened.Close()
+	if reopened.Len() != 2 {
+		t.Errorf("Expected %d, got %d", 2, reopened.Len())
+	}
+	receipt, found := reopened.Get("r1")
+	if !found || receipt.Points != 15 {
+		t.Errorf("Expected %d, got %d", 15, receipt.Points)
+	}
+
+	os.WriteFile(fileName, []byte("not json\n"), 0644)
+	if _, err := openStore(storeBackendFile, fileName); err == nil {
+		t.Error("Expected an error for a corrupt store file")
+	}
+	if _, err := openStore("postgres", ""); err == nil {
+		t.Error("Expected an error for an unknown backend")
+	}
+}
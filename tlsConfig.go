@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// client certificate subjects mapped to the API identity they authenticate as
+var ClientCertIdentities = map[string]string{}
+
+// function to build the server TLS config
+// the certificate is reloaded when the files change on disk, if a client CA is
+// provided client certificates presented by clients are verified against it (mTLS)
+func newTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if clientCAFile != "" {
+		caPEM, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("no certificates found in client CA file " + clientCAFile)
+		}
+		tlsConfig.ClientCAs = clientCAs
+		// certificates are optional so clients using other credentials and public routes such as the health probes
+		// can still connect, the auth mode of the route decides whether a certificate is required
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// function to authenticate a request by its verified client certificate when serving mTLS
+// the subject common name is checked first, then the full subject
+func authenticateClientCert(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", errNoCredentials
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	if identity, found := ClientCertIdentities[subject.CommonName]; found {
+		return identity, nil
+	}
+	if identity, found := ClientCertIdentities[subject.String()]; found {
+		return identity, nil
+	}
+	return "", errors.New("unknown client certificate " + subject.String())
+}
+
+// serves the certificate from disk, reloading it when the cert or key file is modified
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reloadIfModified(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// GetCertificate satisfies tls.Config.GetCertificate
+// a failed reload keeps serving the previously loaded certificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if err := c.reloadIfModified(); err != nil {
+		logger.Error("error reloading TLS certificate", "certFile", c.certFile, "error", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+func (c *certReloader) reloadIfModified() error {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && certInfo.ModTime().Equal(c.certModTime) && keyInfo.ModTime().Equal(c.keyModTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil {
+		logger.Info("reloaded TLS certificate", "certFile", c.certFile)
+	}
+	c.cert = &cert
+	c.certModTime = certInfo.ModTime()
+	c.keyModTime = keyInfo.ModTime()
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Helper function to create a certificate signed by parent (self signed if parent is nil)
+func newTestCert(t *testing.T, commonName string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return cert, key, certPEM, keyPEM
+}
+
+func TestClientCertIdentity(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caPEM, _ := newTestCert(t, "test ca", 1, nil, nil)
+	_, _, serverPEM, serverKeyPEM := newTestCert(t, "127.0.0.1", 2, ca, caKey)
+	_, _, knownPEM, knownKeyPEM := newTestCert(t, "known-client", 3, ca, caKey)
+	_, _, unknownPEM, unknownKeyPEM := newTestCert(t, "unknown-client", 4, ca, caKey)
+	for name, data := range map[string][]byte{"ca.pem": caPEM, "server.pem": serverPEM, "server.key": serverKeyPEM} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ClientCertIdentities["known-client"] = "tenant-a"
+	defer delete(ClientCertIdentities, "known-client")
+	authMode = authModeMTLS
+	defer func() { authMode = authModeChained }()
+
+	tlsConfig, err := newTLSConfig(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, identityFromRequest(r))
+	})))
+	// serve through our own TLS listener, StartTLS would replace the certificate
+	server.Listener = tls.NewListener(server.Listener, tlsConfig)
+	server.Start()
+	defer server.Close()
+	serverURL := "https://" + server.Listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	newClient := func(certPEM, keyPEM []byte) *http.Client {
+		clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{clientCert},
+		}}}
+	}
+
+	// client certificate mapped to an identity
+	resp, err := newClient(knownPEM, knownKeyPEM).Get(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if string(body) != "tenant-a" {
+		t.Errorf("Expected identity %q, got %q", "tenant-a", string(body))
+	}
+
+	// valid client certificate without a mapped identity
+	resp, err = newClient(unknownPEM, unknownKeyPEM).Get(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	// without a client certificate the route decides, public routes such as the health probes are still served
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	for path, expectedStatus := range map[string]int{"/": http.StatusUnauthorized, "/healthz": http.StatusOK} {
+		resp, err = client.Get(serverURL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expectedStatus {
+			t.Errorf("%s: expected status code %d, got %d", path, expectedStatus, resp.StatusCode)
+		}
+	}
+
+	// a client certificate from another CA is never authenticated
+	_, _, otherPEM, otherKeyPEM := newTestCert(t, "known-client", 5, nil, nil)
+	if resp, err = newClient(otherPEM, otherKeyPEM).Get(serverURL); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status code %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+		}
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.pem")
+	keyFile := filepath.Join(dir, "server.key")
+	_, _, certPEM, keyPEM := newTestCert(t, "first", 10, nil, nil)
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := reloader.GetCertificate(nil)
+	if cert.Leaf == nil || cert.Leaf.Subject.CommonName != "first" {
+		t.Fatalf("Expected certificate %q to be served", "first")
+	}
+
+	// replace the files and move the modification time forward
+	_, _, certPEM, keyPEM = newTestCert(t, "second", 11, nil, nil)
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certFile, later, later)
+	_ = os.Chtimes(keyFile, later, later)
+
+	cert, _ = reloader.GetCertificate(nil)
+	if cert.Leaf == nil || cert.Leaf.Subject.CommonName != "second" {
+		t.Errorf("Expected reloaded certificate %q to be served", "second")
+	}
+}
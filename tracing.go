@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// command line flags
+var traceOutput string
+
+// tracer used for all spans, a no-op until tracing is set up
+var tracer = otel.Tracer("fetch_rewards")
+
+// W3C trace context propagation (traceparent / tracestate headers)
+var tracePropagator = propagation.TraceContext{}
+
+// function to set up tracing, spans are exported as JSON to stdout or appended to a file
+// returns a function flushing and stopping the exporter
+func setupTracing(output string) (func(context.Context) error, error) {
+	var w io.Writer = os.Stdout
+	var file *os.File
+	if output != "stdout" {
+		var err error
+		file, err = os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = file
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("receipt-processor"))),
+	)
+	// the tracer obtained from the global provider before setup delegates to this provider
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if file != nil {
+			file.Close()
+		}
+		return err
+	}, nil
+}
+
+// function to trace request handling, continuing the callers trace when a traceparent header is provided
+// the trace ID is added to the request logger so log lines can be tied to spans
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				attribute.String("request.id", requestIDFromContext(ctx)),
+			))
+		defer span.End()
+		if span.SpanContext().IsValid() {
+			ctx = withLogger(ctx, loggerFromContext(ctx).With("traceId", span.SpanContext().TraceID().String()))
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.status))
+		if recorder.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// function to start a span for a store operation
+func startStoreSpan(ctx context.Context, operation string, receiptID string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "store."+operation, trace.WithAttributes(attribute.String("receipt.id", receiptID)))
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTraceRequests(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"trace-key"})
+	router := newRouter()
+
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("POST", "/receipts/process", strings.NewReader(`{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[],"total":"1.00"}`))
+	req.Header.Set("Authorization", "trace-key")
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+		if span.SpanContext().TraceID().String() != traceID {
+			t.Errorf("Expected span %q to continue trace %s, got %s", span.Name(), traceID, span.SpanContext().TraceID())
+		}
+	}
+	for _, name := range []string{"POST /receipts/process", "decode receipt", "calculate points", "rule retailerName", "rule receiptTotal", "rule items", "rule dateAndTime", "store.save"} {
+		if _, found := spans[name]; !found {
+			t.Errorf("Expected span %q to be recorded", name)
+		}
+	}
+	if rule, found := spans["rule retailerName"]; found && rule.Parent().SpanID() != spans["calculate points"].SpanContext().SpanID() {
+		t.Errorf("Expected rule spans to be children of the calculate points span")
+	}
+}
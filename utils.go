@@ -1,13 +1,86 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
 	"math"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
 )
 
+// a named rule contributing points to a receipt
+type scoringRule struct {
+	Name   string
+	Points func(receipt *Receipt) int
+}
+
+// points awarded to a receipt by one scoring rule
+type ruleScore struct {
+	Rule   string `json:"rule"`
+	Points int    `json:"points"`
+}
+
+// scoring rules applied by CalculatePoints, in order
+var scoringRules = []scoringRule{
+	{Name: "retailerName", Points: func(receipt *Receipt) int { return retailerNamePoints(receipt.Retailer) }},
+	{Name: "receiptTotal", Points: receiptTotalPoints},
+	{Name: "items", Points: itemPoints},
+	{Name: "dateAndTime", Points: dateAndTimePoints},
+}
+
+// command line flags
+var rulesFileName string
+
+// rules file selecting the enabled scoring rules, applied in the listed order
+type rulesFile struct {
+	Version string   `json:"version"`
+	Rules   []string `json:"rules"`
+}
+
+// function to load a rules file, returns the enabled scoring rules and the rule set version
+func loadRulesFile(fileName string) ([]scoringRule, string, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, "", err
+	}
+	var config rulesFile
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, "", fmt.Errorf("rules file %s: %w", fileName, err)
+	}
+	if config.Version == "" {
+		return nil, "", fmt.Errorf("rules file %s: version is required", fileName)
+	}
+	if len(config.Rules) == 0 {
+		return nil, "", errors.New("rules file " + fileName + ": at least one rule must be enabled")
+	}
+	available := map[string]scoringRule{}
+	for _, rule := range scoringRules {
+		available[rule.Name] = rule
+	}
+	rules := make([]scoringRule, 0, len(config.Rules))
+	for _, name := range config.Rules {
+		rule, found := available[name]
+		if !found {
+			return nil, "", fmt.Errorf("rules file %s: unknown rule %q", fileName, name)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, config.Version, nil
+}
+
+// function to get the logger for a scoring rule, scoped to the request and receipt when available
+func (receipt *Receipt) ruleLogger(rule string) *slog.Logger {
+	if receipt.log == nil {
+		return logger.With("rule", rule)
+	}
+	return receipt.log.With("rule", rule)
+}
+
 // function to calculate points based on retailer name
 // one point for every alphanumeric character in the retailer name
 func retailerNamePoints(retailer string) int {
@@ -17,9 +90,6 @@ func retailerNamePoints(retailer string) int {
 			points++
 		}
 	}
-	if debugMode {
-		logger.Println("retailer name points", points)
-	}
 	return points
 }
 
@@ -29,9 +99,10 @@ func retailerNamePoints(retailer string) int {
 // Assumption: overall value of zero should return 0 points
 func receiptTotalPoints(receipt *Receipt) int {
 	points := 0
+	log := receipt.ruleLogger("receiptTotal")
 	receiptTotal, err := strconv.ParseFloat(receipt.Total, 64)
 	if err != nil {
-		logger.Println("(receiptTotalPoints) Error parsing total: ", err)
+		log.Warn("error parsing total", "total", receipt.Total, "error", err)
 		receipt.CalulationErr = true
 	} else {
 		if receiptTotal == 0 {
@@ -39,15 +110,11 @@ func receiptTotalPoints(receipt *Receipt) int {
 		}
 		if math.Mod(receiptTotal, 1.00) == 0 {
 			points += 50
-			if debugMode {
-				logger.Println("receiptTotalPoints(1):", points)
-			}
+			log.Debug("round dollar total", "points", points)
 		}
 		if math.Mod(receiptTotal, 0.25) == 0 {
 			points += 25
-			if debugMode {
-				logger.Println("receiptTotalPoints(2)", points)
-			}
+			log.Debug("total multiple of 0.25", "points", points)
 		}
 	}
 	return points
@@ -58,23 +125,20 @@ func receiptTotalPoints(receipt *Receipt) int {
 // If the trimmed length of the item description is a multiple of 3, multiply the price by 0.2 and round up to the nearest integer
 func itemPoints(receipt *Receipt) int {
 	points := 0
+	log := receipt.ruleLogger("items")
 
 	points += (len(receipt.Items) / 2) * 5
-	if debugMode {
-		logger.Println("itemPoints(1):", points)
-	}
+	log.Debug("item pairs", "points", points)
 	for _, item := range receipt.Items {
 		trimmedDescLength := len(strings.TrimSpace(item.ShortDescription))
 		if trimmedDescLength%3 == 0 {
 			price, err := strconv.ParseFloat(item.Price, 64)
 			if err != nil {
-				logger.Println("(itemPoints) Error parsing item price: ", err)
+				log.Warn("error parsing item price", "price", item.Price, "error", err)
 				receipt.CalulationErr = true
 			} else {
 				points += int(math.Ceil(price * 0.2))
-				if debugMode {
-					logger.Println("itemPoints(2)", points)
-				}
+				log.Debug("item description multiple of 3", "shortDescription", item.ShortDescription, "points", points)
 			}
 		}
 	}
@@ -87,32 +151,29 @@ func itemPoints(receipt *Receipt) int {
 // Assume: UTC time
 func dateAndTimePoints(receipt *Receipt) int {
 	points := 0
+	log := receipt.ruleLogger("dateAndTime")
 
 	purchaseDate, err := time.Parse("2006-01-02", receipt.PurchaseDate)
 	if err != nil {
-		logger.Println("(dateAndTimePoints) Error parsing purchase date: ", err)
+		log.Warn("error parsing purchase date", "purchaseDate", receipt.PurchaseDate, "error", err)
 		receipt.CalulationErr = true
 	} else {
 		if purchaseDate.Day()%2 != 0 {
 			points += 6
 		}
-		if debugMode {
-			logger.Println("dateAndTimePoints(1)", points)
-		}
+		log.Debug("purchase day", "points", points)
 	}
 	purchaseTime, err := time.Parse("15:04", receipt.PurchaseTime)
 	startTime := time.Date(0, 1, 1, 14, 0, 0, 0, time.UTC)
 	endTime := time.Date(0, 1, 1, 16, 0, 0, 0, time.UTC)
 	if err != nil {
-		logger.Println("(dateAndTimePoints) Error parsing purchase time: ", err)
+		log.Warn("error parsing purchase time", "purchaseTime", receipt.PurchaseTime, "error", err)
 		receipt.CalulationErr = true
 	} else {
 		if purchaseTime.After(startTime) && purchaseTime.Before(endTime) {
 			points += 10
 		}
-		if debugMode {
-			logger.Println("dateAndTimePoints(2)", points)
-		}
+		log.Debug("purchase time", "points", points)
 	}
 	return points
 }
@@ -3,28 +3,43 @@
 package main
 
 import (
-	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 )
 
 func TestMain(m *testing.M) {
 	logFileName := "logs/testlogfile.log"
-	logger = log.Default()
-	logger.SetFlags(log.LstdFlags | log.Lshortfile)
 	logFile, err := os.OpenFile(logFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-		logger.Println("Failed to open log file: ", err)
+		logger.Error("failed to open log file", "logFile", logFileName, "error", err)
+	} else {
+		defer logFile.Close()
+		logger.Info("logging to file", "logFile", logFileName)
+		logger = newLogger(logFile)
 	}
-	defer logFile.Close()
-	logger.Println("Logging to file: ", logFileName)
-	logger.SetOutput(logFile)
 
 	retCode := m.Run()
 
 	os.Exit(retCode)
 }
 
+// Helper function to send a request with the API key (none when empty) and headers to a handler, returning the recorded response
+func sendRequest(handler http.Handler, method, path, apiKey, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if apiKey != "" {
+		req.Header.Set("Authorization", apiKey)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
 func TestRetailerNamePoints(t *testing.T) {
 	// empty retailer name
 	expectedPoints := 0
@@ -262,3 +277,23 @@ func TestDateAndTimePoints(t *testing.T) {
 		t.Errorf("Expected calculation error = true, got %v", errReceipt.CalulationErr)
 	}
 }
+
+func TestLoadRulesFile(t *testing.T) {
+	dir := t.TempDir()
+	rulesFileName := dir + "/rules.json"
+	os.WriteFile(rulesFileName, []byte(`{"version": "2", "rules": ["items", "retailerName"]}`), 0644)
+	rules, version, err := loadRulesFile(rulesFileName)
+	if err != nil {
+		t.Fatalf("Error loading rules file: %v", err)
+	}
+	if version != "2" || len(rules) != 2 || rules[0].Name != "items" || rules[1].Name != "retailerName" {
+		t.Errorf("Unexpected rules %v version %s", rules, version)
+	}
+	// unknown rule, missing version and no rules enabled
+	for _, content := range []string{`{"version": "2", "rules": ["bonus"]}`, `{"rules": ["items"]}`, `{"version": "2", "rules": []}`} {
+		os.WriteFile(rulesFileName, []byte(content), 0644)
+		if _, _, err := loadRulesFile(rulesFileName); err == nil {
+			t.Errorf("Expected an error for %s", content)
+		}
+	}
+}
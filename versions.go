@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// date the unprefixed routes were deprecated in favour of /v1
+var legacyDeprecatedAt = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+// command line flags
+var legacySunsetAt = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+
+// function to register the v1 receipt routes
+func handleReceiptRoutesV1(r *mux.Router) {
+	r.HandleFunc("/receipts/process", ProcessReceipts).Methods("POST").Name("receipt.process")
+	r.HandleFunc("/receipts/{id}/points", GetPoints).Methods("GET").Name("receipt.points")
+}
+
+// function to register the v2 receipt routes
+// listing, whole receipts, revisions and corrections are v2 only, v1 and the unprefixed aliases keep the original two routes
+func handleReceiptRoutesV2(r *mux.Router) {
+	r.HandleFunc("/receipts/process", ProcessReceiptsV2).Methods("POST").Name("receipt.process")
+	r.HandleFunc("/receipts/{id}/points", GetPointsV2).Methods("GET").Name("receipt.points")
+	r.HandleFunc("/receipts", ListReceiptsV2).Methods("GET").Name("receipt.list")
+	r.HandleFunc("/receipts/{id}", GetReceiptV2).Methods("GET").Name("receipt.get")
+	r.HandleFunc("/receipts/{id}/revisions", GetReceiptRevisionsV2).Methods("GET").Name("receipt.revisions")
+	// corrections are made by support, receipts are not owned by the keys submitting them
+	r.Handle("/receipts/{id}", requireAdmin(http.HandlerFunc(CorrectReceiptV2))).Methods("PUT").Name("receipt.correct")
+	r.Handle("/receipts/{id}", requireAdmin(http.HandlerFunc(PatchReceiptV2))).Methods("PATCH").Name("receipt.patch")
+	r.Handle("/receipts/{id}", requireAdmin(http.HandlerFunc(DeleteReceiptV2))).Methods("DELETE").Name("receipt.delete")
+}
+
+// function to mark responses from the unprefixed routes as deprecated (RFC 9745) with a sunset date (RFC 8594)
+// the Link header points to the equivalent v1 route
+func deprecateLegacyRoutes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "@"+strconv.FormatInt(legacyDeprecatedAt.Unix(), 10))
+		w.Header().Set("Sunset", legacySunsetAt.UTC().Format(http.TimeFormat))
+		w.Header().Add("Link", "</v1"+r.URL.Path+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// function to process a receipt, v2 responds 201 with the points awarded and the location of the receipt points
+func ProcessReceiptsV2(w http.ResponseWriter, r *http.Request) {
+	receipt, ok := processReceipt(w, r)
+	if !ok {
+		return
+	}
+	response := struct {
+		ID     string `json:"id"`
+		Points int    `json:"points"`
+	}{
+		ID:     receipt.ID,
+		Points: receipt.Points,
+	}
+	w.Header().Set("Location", "/v2/receipts/"+receipt.ID+"/points")
+	setReceiptValidators(w, receipt)
+	writeJSON(w, r, http.StatusCreated, response)
+}
+
+// function to look up points for a receipt, v2 includes the points awarded by each scoring rule
+func GetPointsV2(w http.ResponseWriter, r *http.Request) {
+	receipt, found := findReceipt(w, r)
+	if !found || receiptNotModified(w, r, receipt) {
+		return
+	}
+	response := struct {
+		ID               string      `json:"id"`
+		Points           int         `json:"points"`
+		CalculationError bool        `json:"calculationError"`
+		Breakdown        []ruleScore `json:"breakdown"`
+	}{
+		ID:               receipt.ID,
+		Points:           receipt.Points,
+		CalculationError: receipt.CalulationErr,
+		Breakdown:        receipt.Breakdown,
+	}
+	if response.Breakdown == nil {
+		response.Breakdown = []ruleScore{}
+	}
+	writeJSON(w, r, http.StatusOK, response)
+}
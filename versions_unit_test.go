@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVersionedRoutes(t *testing.T) {
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"version-user"})
+	router := newRouter()
+
+	receipt := `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[{"shortDescription":"Mountain Dew 12PK","price":"6.49"}],"total":"6.49"}`
+
+	// v1 and the unprefixed aliases share the same response shape, only the aliases are deprecated
+	for _, prefix := range []string{"/v1", ""} {
+		rr := sendRequest(router, "POST", prefix+"/receipts/process", "version-user", receipt, nil)
+		var processed struct {
+			ID string `json:"id"`
+		}
+		json.NewDecoder(rr.Body).Decode(&processed)
+		if rr.Code != http.StatusOK || processed.ID == "" {
+			t.Fatalf("%s: expected status code %d with an ID, got %d", prefix, http.StatusOK, rr.Code)
+		}
+		rr = sendRequest(router, "GET", prefix+"/receipts/"+processed.ID+"/points", "version-user", "", nil)
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"points":`) {
+			t.Errorf("%s: unexpected points response %d %s", prefix, rr.Code, rr.Body.String())
+		}
+
+		deprecation, sunset, link := rr.Header().Get("Deprecation"), rr.Header().Get("Sunset"), rr.Header().Get("Link")
+		if prefix == "" {
+			if deprecation != "@1792368000" || sunset != "Fri, 30 Apr 2027 00:00:00 GMT" || link != `</v1/receipts/`+processed.ID+`/points>; rel="successor-version"` {
+				t.Errorf("Unexpected deprecation headers %q %q %q", deprecation, sunset, link)
+			}
+		} else if deprecation != "" || sunset != "" || link != "" {
+			t.Errorf("Expected no deprecation headers for v1, got %q %q %q", deprecation, sunset, link)
+		}
+	}
+
+	// v2 returns the points and a breakdown by scoring rule
+	rr := sendRequest(router, "POST", "/v2/receipts/process", "version-user", receipt, nil)
+	var processed struct {
+		ID     string `json:"id"`
+		Points int    `json:"points"`
+	}
+	json.NewDecoder(rr.Body).Decode(&processed)
+	if rr.Code != http.StatusCreated || rr.Header().Get("Location") != "/v2/receipts/"+processed.ID+"/points" {
+		t.Fatalf("Expected status code %d with a location, got %d %q", http.StatusCreated, rr.Code, rr.Header().Get("Location"))
+	}
+	rr = sendRequest(router, "GET", "/v2/receipts/"+processed.ID+"/points", "version-user", "", nil)
+	var points struct {
+		Points    int         `json:"points"`
+		Breakdown []ruleScore `json:"breakdown"`
+	}
+	json.NewDecoder(rr.Body).Decode(&points)
+	if len(points.Breakdown) != len(scoringRules) {
+		t.Fatalf("Expected %d, got %d", len(scoringRules), len(points.Breakdown))
+	}
+	total := 0
+	for i, score := range points.Breakdown {
+		if score.Rule != scoringRules[i].Name {
+			t.Errorf("Expected rule %s, got %s", scoringRules[i].Name, score.Rule)
+		}
+		total += score.Points
+	}
+	if total != points.Points || points.Points != processed.Points {
+		t.Errorf("Expected breakdown to add up to %d, got %d", points.Points, total)
+	}
+
+	// listing, reading whole receipts and corrections are only available in v2
+	for _, prefix := range []string{"/v1", ""} {
+		for _, test := range []struct{ method, path string }{
+			{"GET", "/receipts"},
+			{"GET", "/receipts/" + processed.ID},
+			{"GET", "/receipts/" + processed.ID + "/revisions"},
+			{"PUT", "/receipts/" + processed.ID},
+			{"PATCH", "/receipts/" + processed.ID},
+			{"DELETE", "/receipts/" + processed.ID},
+		} {
+			if rr := sendRequest(router, test.method, prefix+test.path, "version-user", `{"reason":"duplicate"}`, nil); rr.Code != http.StatusNotFound {
+				t.Errorf("%s %s: expected status code %d, got %d", test.method, prefix+test.path, http.StatusNotFound, rr.Code)
+			}
+		}
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+// command line flags
+var webhookMaxAttempts = 5
+var webhookBackoff = time.Second // delay before the first retry, doubled after each failed attempt
+var webhookTimeout = 10 * time.Second
+
+const (
+	webhookWorkers     = 4
+	webhookQueueSize   = 1000
+	maxWebhookBackoff  = time.Hour
+	maxDeadLetters     = 1000
+	webhookAllTenants  = "*"
+	webhookSecretBytes = 32
+)
+
+// webhook event types
+const (
+	eventReceiptProcessed = "receipt.processed" // a receipt was scored
+	eventReceiptFlagged   = "receipt.flagged"   // a receipt was scored with a calculation error
+	eventReceiptAdjusted  = "receipt.adjusted"  // a corrected receipt was scored again
+)
+
+var webhookEventTypes = []string{eventReceiptProcessed, eventReceiptFlagged, eventReceiptAdjusted}
+
+// URL registered by an admin to receive a tenant's events, tenant * receives the events of every tenant
+type webhookSubscription struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"` // only returned when the subscription is created
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+func (s webhookSubscription) receives(tenant string, eventType string) bool {
+	return (s.Tenant == tenant || s.Tenant == webhookAllTenants) && slices.Contains(s.Events, eventType)
+}
+
+// JSON body posted to subscribers, the ID is the same for every attempt so receivers can ignore duplicates
+type webhookEvent struct {
+	ID        string           `json:"id"`
+	Type      string           `json:"type"`
+	Tenant    string           `json:"tenant"`
+	CreatedAt time.Time        `json:"createdAt"`
+	Data      receiptEventData `json:"data"`
+}
+
+type receiptEventData struct {
+	ReceiptID        string `json:"receiptId"`
+	Revision         int    `json:"revision"`
+	Points           int    `json:"points"`
+	CalculationError bool   `json:"calculationError"`
+	PreviousPoints   *int   `json:"previousPoints,omitempty"` // receipt.adjusted only
+	PointsChange     *int   `json:"pointsChange,omitempty"`   // receipt.adjusted only
+}
+
+// event queued for delivery to one subscription
+type webhookDelivery struct {
+	subscription webhookSubscription
+	event        webhookEvent
+	body         []byte
+	attempts     int
+	lastError    string
+}
+
+// delivery given up on after webhookMaxAttempts attempts
+type deadLetter struct {
+	SubscriptionID string       `json:"subscriptionId"`
+	URL            string       `json:"url"`
+	Event          webhookEvent `json:"event"`
+	Attempts       int          `json:"attempts"`
+	LastError      string       `json:"lastError"`
+	FailedAt       time.Time    `json:"failedAt"`
+}
+
+// delivers events to subscriptions in the background, retrying failed deliveries with exponential backoff
+// subscriptions and dead letters are not persisted, they are lost on restart
+type webhookDispatcher struct {
+	mu            sync.Mutex
+	subscriptions map[string]webhookSubscription
+	deadLetters   []deadLetter
+	queue         chan *webhookDelivery
+	client        *http.Client
+	done          chan struct{}
+	stopOnce      sync.Once
+	workers       sync.WaitGroup
+}
+
+var webhooks = newWebhookDispatcher()
+
+func newWebhookDispatcher() *webhookDispatcher {
+	d := &webhookDispatcher{
+		subscriptions: map[string]webhookSubscription{},
+		queue:         make(chan *webhookDelivery, webhookQueueSize),
+		// redirects are not followed, a receiver must respond 2xx itself
+		client: &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }},
+		done:   make(chan struct{}),
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		d.workers.Add(1)
+		go d.work()
+	}
+	return d
+}
+
+// function to stop the dispatcher once in-flight deliveries complete, queued and pending retries are dropped
+func (d *webhookDispatcher) stop() {
+	d.stopOnce.Do(func() {
+		close(d.done)
+		d.workers.Wait()
+		if pending := len(d.queue); pending > 0 {
+			logger.Warn("webhook deliveries dropped on shutdown", "deliveries", pending)
+		}
+	})
+}
+
+func (d *webhookDispatcher) work() {
+	defer d.workers.Done()
+	for {
+		select {
+		case <-d.done:
+			return
+		case delivery := <-d.queue:
+			d.deliver(delivery)
+		}
+	}
+}
+
+// function to queue an event for every subscription of the tenant receiving its type, never blocks the caller
+func (d *webhookDispatcher) publish(tenant string, eventType string, data receiptEventData) {
+	d.mu.Lock()
+	var targets []webhookSubscription
+	for _, subscription := range d.subscriptions {
+		if subscription.receives(tenant, eventType) {
+			targets = append(targets, subscription)
+		}
+	}
+	d.mu.Unlock()
+	if len(targets) == 0 {
+		return
+	}
+
+	event := webhookEvent{ID: uuid.New().String(), Type: eventType, Tenant: tenant, CreatedAt: time.Now().UTC(), Data: data}
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("error encoding webhook event", "eventId", event.ID, "error", err)
+		return
+	}
+	for _, subscription := range targets {
+		d.enqueue(&webhookDelivery{subscription: subscription, event: event, body: body})
+	}
+}
+
+func (d *webhookDispatcher) enqueue(delivery *webhookDelivery) {
+	select {
+	case <-d.done:
+		logger.Warn("webhook dispatcher stopped, delivery dropped", "subscriptionId", delivery.subscription.ID, "eventId", delivery.event.ID)
+		return
+	default:
+	}
+	select {
+	case d.queue <- delivery:
+	default:
+		delivery.lastError = "delivery queue is full"
+		d.deadLetter(delivery)
+	}
+}
+
+// function to attempt a delivery, scheduling a retry or dead lettering it when the attempt fails
+func (d *webhookDispatcher) deliver(delivery *webhookDelivery) {
+	d.mu.Lock()
+	_, subscribed := d.subscriptions[delivery.subscription.ID]
+	d.mu.Unlock()
+	if !subscribed {
+		return
+	}
+
+	delivery.attempts++
+	log := logger.With("subscriptionId", delivery.subscription.ID, "eventId", delivery.event.ID, "eventType", delivery.event.Type, "attempt", delivery.attempts)
+	err := d.post(delivery)
+	if err == nil {
+		webhookDeliveriesTotal.WithLabelValues("delivered").Inc()
+		log.Debug("webhook delivered")
+		return
+	}
+	delivery.lastError = err.Error()
+	if delivery.attempts >= webhookMaxAttempts {
+		log.Error("webhook delivery failed, giving up", "error", err)
+		d.deadLetter(delivery)
+		return
+	}
+	delay := webhookRetryDelay(delivery.attempts)
+	log.Warn("webhook delivery failed, retrying", "error", err, "retryIn", delay.String())
+	webhookDeliveriesTotal.WithLabelValues("retried").Inc()
+	time.AfterFunc(delay, func() { d.enqueue(delivery) })
+}
+
+// function to return the delay before retrying a delivery that failed the given number of attempts
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := webhookBackoff
+	for i := 1; i < attempts && delay < maxWebhookBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxWebhookBackoff)
+}
+
+// function to post an event signed like partner requests (see authenticateHMAC),
+// the key ID is the subscription ID and the nonce is unique to each attempt
+func (d *webhookDispatcher) post(delivery *webhookDelivery) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.subscription.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return err
+	}
+	// the path is signed as sent, an empty path is requested as /
+	path := req.URL.Path
+	if path == "" {
+		path = "/"
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := uuid.New().String()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(hmacKeyIDHeader, delivery.subscription.ID)
+	req.Header.Set(hmacTimestampHeader, timestamp)
+	req.Header.Set(hmacNonceHeader, nonce)
+	req.Header.Set(hmacSignatureHeader, computeHMACSignature(delivery.subscription.Secret, req.Method, path, timestamp, nonce, delivery.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("receiver responded %s", resp.Status)
+	}
+	return nil
+}
+
+func (d *webhookDispatcher) deadLetter(delivery *webhookDelivery) {
+	webhookDeliveriesTotal.WithLabelValues("dead_lettered").Inc()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deadLetters = append(d.deadLetters, deadLetter{
+		SubscriptionID: delivery.subscription.ID,
+		URL:            delivery.subscription.URL,
+		Event:          delivery.event,
+		Attempts:       delivery.attempts,
+		LastError:      delivery.lastError,
+		FailedAt:       time.Now().UTC(),
+	})
+	if len(d.deadLetters) > maxDeadLetters {
+		d.deadLetters = d.deadLetters[len(d.deadLetters)-maxDeadLetters:]
+	}
+}
+
+// function to publish the events for a scored receipt to webhooks and event streams,
+// previous is the receipt before a correction
+func publishReceiptEvents(receipt Receipt, previous *Receipt) {
+	data := receiptEventData{
+		ReceiptID:        receipt.ID,
+		Revision:         len(receipt.Revisions) + 1,
+		Points:           receipt.Points,
+		CalculationError: receipt.CalulationErr,
+	}
+	publish := func(eventType string) {
+		webhooks.publish(receipt.Tenant, eventType, data)
+		receiptEvents.publish(receipt.Tenant, eventType, data)
+	}
+	if previous == nil {
+		publish(eventReceiptProcessed)
+	} else {
+		change := receipt.Points - previous.Points
+		data.PreviousPoints, data.PointsChange = &previous.Points, &change
+		publish(eventReceiptAdjusted)
+	}
+	if receipt.CalulationErr {
+		publish(eventReceiptFlagged)
+	}
+}
+
+// function to register a webhook subscription, e.g. {"tenant": "a1b2c3d4", "url": "https://example.com/hooks"}
+// events defaults to every event type, the response has the secret used to sign deliveries
+func CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Tenant string   `json:"tenant"`
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeRequestError(w, r, decodeError(err))
+		return
+	}
+	if fieldErr := validateWebhookRequest(req.Tenant, req.URL, req.Events); fieldErr != nil {
+		p := newProblem(http.StatusBadRequest, "invalid webhook subscription")
+		p.Errors = []fieldError{*fieldErr}
+		writeProblem(w, r, p)
+		return
+	}
+	events := slices.Clone(req.Events)
+	if len(events) == 0 {
+		events = slices.Clone(webhookEventTypes)
+	}
+	slices.Sort(events)
+
+	secret := make([]byte, webhookSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		loggerFromContext(r.Context()).Error("error generating webhook secret", "error", err)
+		writeError(w, r, http.StatusInternalServerError, "")
+		return
+	}
+	subscription := webhookSubscription{
+		ID:        uuid.New().String(),
+		Tenant:    req.Tenant,
+		URL:       req.URL,
+		Events:    slices.Compact(events),
+		Secret:    hex.EncodeToString(secret),
+		CreatedAt: time.Now().UTC(),
+	}
+	webhooks.mu.Lock()
+	webhooks.subscriptions[subscription.ID] = subscription
+	webhooks.mu.Unlock()
+
+	loggerFromContext(r.Context()).Info("webhook subscription created", "subscriptionId", subscription.ID, "tenant", subscription.Tenant, "url", subscription.URL)
+	w.Header().Set("Location", "/admin/webhooks/"+subscription.ID)
+	writeJSON(w, r, http.StatusCreated, subscription)
+}
+
+// function to validate a webhook subscription request, returns the field at fault
+func validateWebhookRequest(tenant string, rawURL string, events []string) *fieldError {
+	if strings.TrimSpace(tenant) == "" {
+		return &fieldError{Field: "tenant", Message: "must be a key ID or * for every tenant"}
+	}
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return &fieldError{Field: "url", Message: "must be an absolute http or https URL"}
+	}
+	for _, event := range events {
+		if !slices.Contains(webhookEventTypes, event) {
+			return &fieldError{Field: "events", Message: "must only contain " + strings.Join(webhookEventTypes, ", ")}
+		}
+	}
+	return nil
+}
+
+// function to list the webhook subscriptions, oldest first and without their secrets
+func ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	webhooks.mu.Lock()
+	subscriptions := make([]webhookSubscription, 0, len(webhooks.subscriptions))
+	for _, subscription := range webhooks.subscriptions {
+		subscription.Secret = ""
+		subscriptions = append(subscriptions, subscription)
+	}
+	webhooks.mu.Unlock()
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].CreatedAt.Before(subscriptions[j].CreatedAt) })
+	writeJSON(w, r, http.StatusOK, subscriptions)
+}
+
+// function to remove a webhook subscription, pending retries to it are dropped
+func DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	webhooks.mu.Lock()
+	_, found := webhooks.subscriptions[id]
+	delete(webhooks.subscriptions, id)
+	webhooks.mu.Unlock()
+	if !found {
+		writeError(w, r, http.StatusNotFound, "no webhook subscription found for id "+id)
+		return
+	}
+	loggerFromContext(r.Context()).Info("webhook subscription deleted", "subscriptionId", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// function to list the deliveries given up on, oldest first
+func GetWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	webhooks.mu.Lock()
+	deadLetters := append([]deadLetter{}, webhooks.deadLetters...)
+	webhooks.mu.Unlock()
+	writeJSON(w, r, http.StatusOK, deadLetters)
+}
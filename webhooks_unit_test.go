@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// local webhook receiver recording the events it accepts, failing the first failures attempts
+type testWebhookReceiver struct {
+	mu       sync.Mutex
+	secret   string
+	failures int
+	attempts int
+	events   []webhookEvent
+	nonces   map[string]bool
+}
+
+func (rcv *testWebhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.attempts++
+	body, _ := io.ReadAll(r.Body)
+	timestamp, nonce := r.Header.Get(hmacTimestampHeader), r.Header.Get(hmacNonceHeader)
+	if r.Header.Get(hmacSignatureHeader) != computeHMACSignature(rcv.secret, r.Method, r.URL.Path, timestamp, nonce, body) || rcv.nonces[nonce] {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	rcv.nonces[nonce] = true
+	if rcv.attempts <= rcv.failures {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var event webhookEvent
+	json.Unmarshal(body, &event)
+	rcv.events = append(rcv.events, event)
+}
+
+func (rcv *testWebhookReceiver) received() []webhookEvent {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]webhookEvent{}, rcv.events...)
+}
+
+func TestWebhooks(t *testing.T) {
+	limiter = newRateLimiter()
+	hashAPIKeys([]string{"hook-user", "hook-other", "hook-admin"})
+	tenant, adminID := APIKeys["hook-user"], APIKeys["hook-admin"]
+	AdminKeyIDs[adminID] = true
+	savedWebhooks, savedMaxAttempts, savedBackoff := webhooks, webhookMaxAttempts, webhookBackoff
+	webhooks, webhookMaxAttempts, webhookBackoff = newWebhookDispatcher(), 3, 10*time.Millisecond
+	defer func() {
+		webhooks.stop()
+		webhooks, webhookMaxAttempts, webhookBackoff = savedWebhooks, savedMaxAttempts, savedBackoff
+		delete(AdminKeyIDs, adminID)
+	}()
+	router := newRouter()
+
+	subscribe := func(tenant string, url string, events string) webhookSubscription {
+		rr := sendRequest(router, "POST", "/admin/webhooks", "hook-admin", `{"tenant":"`+tenant+`","url":"`+url+`","events":`+events+`}`, nil)
+		var subscription webhookSubscription
+		json.NewDecoder(rr.Body).Decode(&subscription)
+		if rr.Code != http.StatusCreated || subscription.Secret == "" {
+			t.Fatalf("Expected status code %d with a secret, got %d", http.StatusCreated, rr.Code)
+		}
+		return subscription
+	}
+
+	// the receiver fails the first attempt, the retry is signed with a new nonce
+	receiver := &testWebhookReceiver{failures: 1, nonces: map[string]bool{}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	subscription := subscribe(tenant, server.URL+"/hooks", `[]`)
+	receiver.mu.Lock()
+	receiver.secret = subscription.Secret
+	receiver.mu.Unlock()
+
+	rr := sendRequest(router, "POST", "/v2/receipts/process", "hook-user", `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[],"total":"6.49"}`, nil)
+	var processed struct {
+		ID     string `json:"id"`
+		Points int    `json:"points"`
+	}
+	json.NewDecoder(rr.Body).Decode(&processed)
+	sendRequest(router, "POST", "/v2/receipts/process", "hook-other", `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[],"total":"6.49"}`, nil)
+	sendRequest(router, "POST", "/v2/receipts/process", "hook-user", `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[],"total":"abc"}`, nil)
+	sendRequest(router, "PATCH", "/v2/receipts/"+processed.ID, "hook-admin", `{"total":"7.00"}`, nil)
+
+	if !waitFor(5*time.Second, func() bool { return len(receiver.received()) == 4 }) {
+		t.Fatalf("Expected %d events, got %+v", 4, receiver.received())
+	}
+	received := map[string]webhookEvent{}
+	for _, event := range receiver.received() {
+		if event.Tenant != tenant {
+			t.Errorf("Expected only events of tenant %s, got %+v", tenant, event)
+		}
+		if event.Type != eventReceiptProcessed || event.Data.ReceiptID == processed.ID {
+			received[event.Type] = event
+		}
+	}
+	if event := received[eventReceiptProcessed]; event.Data.ReceiptID != processed.ID || event.Data.Points != processed.Points || event.Data.Revision != 1 {
+		t.Errorf("Unexpected processed event %+v", event)
+	}
+	if event := received[eventReceiptFlagged]; !event.Data.CalculationError {
+		t.Errorf("Unexpected flagged event %+v", event)
+	}
+	event := received[eventReceiptAdjusted]
+	if event.Data.Revision != 2 || event.Data.PreviousPoints == nil || *event.Data.PreviousPoints != processed.Points ||
+		event.Data.PointsChange == nil || *event.Data.PointsChange != 75 || event.Data.Points != processed.Points+75 {
+		t.Errorf("Unexpected adjusted event %+v", event)
+	}
+
+	// deliveries failing every attempt are dead lettered
+	failing := &testWebhookReceiver{failures: 100, nonces: map[string]bool{}}
+	failingServer := httptest.NewServer(failing)
+	defer failingServer.Close()
+	failingSubscription := subscribe(webhookAllTenants, failingServer.URL, `["receipt.flagged"]`)
+	failing.mu.Lock()
+	failing.secret = failingSubscription.Secret
+	failing.mu.Unlock()
+	sendRequest(router, "POST", "/v2/receipts/process", "hook-other", `{"retailer":"Target","purchaseDate":"2022-01-01","purchaseTime":"13:01","items":[],"total":"abc"}`, nil)
+
+	var deadLetters []deadLetter
+	waitFor(5*time.Second, func() bool {
+		rr := sendRequest(router, "GET", "/admin/webhooks/deadletters", "hook-admin", "", nil)
+		json.NewDecoder(rr.Body).Decode(&deadLetters)
+		return len(deadLetters) > 0
+	})
+	if len(deadLetters) != 1 || deadLetters[0].SubscriptionID != failingSubscription.ID || deadLetters[0].Attempts != 3 ||
+		deadLetters[0].Event.Type != eventReceiptFlagged || !strings.Contains(deadLetters[0].LastError, "503") {
+		t.Errorf("Unexpected dead letters %+v", deadLetters)
+	}
+
+	// subscriptions are listed without their secrets and can be deleted
+	rr = sendRequest(router, "GET", "/admin/webhooks", "hook-admin", "", nil)
+	if rr.Code != http.StatusOK || strings.Contains(rr.Body.String(), subscription.Secret) || !strings.Contains(rr.Body.String(), subscription.ID) {
+		t.Errorf("Expected the subscriptions without secrets, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := sendRequest(router, "DELETE", "/admin/webhooks/"+subscription.ID, "hook-admin", "", nil); rr.Code != http.StatusNoContent {
+		t.Errorf("Expected status code %d, got %d", http.StatusNoContent, rr.Code)
+	}
+	if rr := sendRequest(router, "DELETE", "/admin/webhooks/"+subscription.ID, "hook-admin", "", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, rr.Code)
+	}
+
+	// invalid subscriptions
+	for _, test := range []struct {
+		apiKey         string
+		body           string
+		expectedStatus int
+	}{
+		{"hook-user", `{"tenant":"a","url":"https://example.com"}`, http.StatusForbidden},
+		{"hook-admin", `{"tenant":"","url":"https://example.com"}`, http.StatusBadRequest},
+		{"hook-admin", `{"tenant":"a","url":"ftp://example.com"}`, http.StatusBadRequest},
+		{"hook-admin", `{"tenant":"a","url":"/hooks"}`, http.StatusBadRequest},
+		{"hook-admin", `{"tenant":"a","url":"https://example.com","events":["receipt.deleted"]}`, http.StatusBadRequest},
+	} {
+		if rr := sendRequest(router, "POST", "/admin/webhooks", test.apiKey, test.body, nil); rr.Code != test.expectedStatus {
+			t.Errorf("%s: expected status code %d, got %d", test.body, test.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func TestWebhookRetryDelay(t *testing.T) {
+	savedBackoff := webhookBackoff
+	webhookBackoff = time.Second
+	defer func() { webhookBackoff = savedBackoff }()
+
+	for attempts, expected := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 20: maxWebhookBackoff} {
+		if delay := webhookRetryDelay(attempts); delay != expected {
+			t.Errorf("Expected %s, got %s", expected, delay)
+		}
+	}
+}